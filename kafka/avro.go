@@ -0,0 +1,534 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a schema that could not be found is remembered as missing,
+// so a topic full of unknown schemas does not query the registry per message
+const avroMissingSchemaTTL = time.Minute
+
+// Most array and map items read from one message, across all its blocks. Items
+// can take no bytes, such as nulls, so a block's count can't be checked against
+// the bytes left.
+const avroMaxItems = 1 << 20
+
+// avroDecoder decodes Avro binary messages to JSON. Messages in the Confluent
+// wire format (a 0 byte, then a 4 byte big endian schema ID, then the Avro body)
+// are decoded with the schema of that ID. Other messages are decoded with the
+// latest schema of the "<topic>-value" subject, or "<topic>-key" for keys.
+type avroDecoder struct {
+	schemas *avroSchemaSource
+}
+
+// NewAvroDecoder returns an Avro decoder that finds schemas in schemaDir, as
+// <id>.avsc or <subject>.avsc files, and then in the schema registry at
+// registryURL. Either may be empty.
+func NewAvroDecoder(schemaDir string, registryURL string) Decoder {
+	return avroDecoder{schemas: &avroSchemaSource{
+		dir:         schemaDir,
+		registryURL: strings.TrimRight(registryURL, "/"),
+		http:        &http.Client{Timeout: 5 * time.Second},
+		byID:        make(map[string]*avroSchema),
+		bySubject:   make(map[string]*avroSchema),
+		missing:     make(map[string]time.Time),
+		pending:     make(map[string]*avroLookup),
+	}}
+}
+
+func (avroDecoder) Name() string { return "avro" }
+
+func (d avroDecoder) Decode(topic string, key bool, data []byte) (string, error) {
+	var schema *avroSchema
+	var err error
+	body := data
+	if len(data) >= 5 && data[0] == 0 {
+		schema, err = d.schemas.byIDLookup(int32(binary.BigEndian.Uint32(data[1:5])))
+		body = data[5:]
+	} else if key {
+		schema, err = d.schemas.bySubjectLookup(topic + "-key")
+	} else {
+		schema, err = d.schemas.bySubjectLookup(topic + "-value")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	reader := &avroReader{data: body}
+	value, err := reader.read(schema)
+	if err != nil {
+		return "", err
+	}
+	if reader.pos != len(body) {
+		return "", fmt.Errorf("%d bytes left after decoding with schema %s", len(body)-reader.pos, schema.name)
+	}
+
+	pretty, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(pretty), nil
+}
+
+// avroSchemaSource finds and caches schemas by ID or subject
+type avroSchemaSource struct {
+	dir         string
+	registryURL string
+	http        *http.Client
+
+	lock      sync.Mutex
+	byID      map[string]*avroSchema
+	bySubject map[string]*avroSchema
+	missing   map[string]time.Time // lookups that failed, and when
+	pending   map[string]*avroLookup
+}
+
+// avroLookup is a schema being fetched, which other lookups of it wait for
+type avroLookup struct {
+	done   chan struct{}
+	schema *avroSchema
+	err    error
+}
+
+func (s *avroSchemaSource) byIDLookup(id int32) (*avroSchema, error) {
+	idStr := fmt.Sprint(id)
+	return s.lookup(s.byID, "id "+idStr, idStr, "/schemas/ids/"+idStr)
+}
+
+func (s *avroSchemaSource) bySubjectLookup(subject string) (*avroSchema, error) {
+	return s.lookup(s.bySubject, "subject "+subject, subject, "/subjects/"+url.PathEscape(subject)+"/versions/latest")
+}
+
+// lookup returns a cached schema, or else fetches it. The lock isn't held
+// while fetching, so a slow registry only holds up lookups of the same schema.
+func (s *avroSchemaSource) lookup(cache map[string]*avroSchema, what string, file string, registryPath string) (*avroSchema, error) {
+	s.lock.Lock()
+	if schema, ok := cache[file]; ok {
+		s.lock.Unlock()
+		return schema, nil
+	}
+	if at, ok := s.missing[what]; ok && time.Since(at) < avroMissingSchemaTTL {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("no Avro schema for %s", what)
+	}
+	if pending, ok := s.pending[what]; ok {
+		s.lock.Unlock()
+		<-pending.done
+		return pending.schema, pending.err
+	}
+	pending := &avroLookup{done: make(chan struct{})}
+	s.pending[what] = pending
+	s.lock.Unlock()
+
+	pending.schema, pending.err = s.load(what, file, registryPath)
+
+	s.lock.Lock()
+	if pending.err != nil {
+		s.missing[what] = time.Now()
+	} else {
+		cache[file] = pending.schema
+	}
+	delete(s.pending, what)
+	s.lock.Unlock()
+
+	close(pending.done)
+	return pending.schema, pending.err
+}
+
+// load fetches and parses a schema
+func (s *avroSchemaSource) load(what string, file string, registryPath string) (*avroSchema, error) {
+	schemaJSON, err := s.fetch(file, registryPath)
+	if err != nil {
+		return nil, fmt.Errorf("no Avro schema for %s: %s", what, err.Error())
+	}
+
+	schema, err := parseAvroSchema(schemaJSON)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema for %s: %s", what, err.Error())
+	}
+	return schema, nil
+}
+
+// fetch reads a schema from the schema directory, or else the registry
+func (s *avroSchemaSource) fetch(file string, registryPath string) ([]byte, error) {
+	if s.dir != "" {
+		schemaJSON, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.Base(file)+".avsc"))
+		if err == nil {
+			return schemaJSON, nil
+		}
+		if !os.IsNotExist(err) || s.registryURL == "" {
+			return nil, err
+		}
+	}
+	if s.registryURL == "" {
+		return nil, fmt.Errorf("no schema directory or registry configured")
+	}
+
+	response, err := s.http.Get(s.registryURL + registryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry returned %s", response.Status)
+	}
+
+	var registered struct {
+		Schema string `json:"schema"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&registered)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(registered.Schema), nil
+}
+
+// avroSchema is a parsed Avro schema
+type avroSchema struct {
+	kind     string // primitive type name, or record, enum, array, map, union or fixed
+	name     string // full name of named types
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema // array items and map values
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func parseAvroSchema(schemaJSON []byte) (*avroSchema, error) {
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(schemaJSON))
+	decoder.UseNumber()
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := avroSchemaParser{named: make(map[string]*avroSchema)}
+	return parser.parse(raw, "")
+}
+
+type avroSchemaParser struct {
+	named map[string]*avroSchema
+}
+
+func (p avroSchemaParser) parse(raw interface{}, namespace string) (*avroSchema, error) {
+	switch schema := raw.(type) {
+	case string:
+		if avroPrimitives[schema] {
+			return &avroSchema{kind: schema}, nil
+		}
+		if named, ok := p.named[avroFullName(schema, namespace)]; ok {
+			return named, nil
+		}
+		if named, ok := p.named[schema]; ok {
+			return named, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", schema)
+
+	case []interface{}:
+		union := &avroSchema{kind: "union"}
+		for _, branch := range schema {
+			parsed, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, parsed)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return p.parseComplex(schema, namespace)
+	}
+	return nil, fmt.Errorf("invalid schema %v", raw)
+}
+
+func (p avroSchemaParser) parseComplex(schema map[string]interface{}, namespace string) (*avroSchema, error) {
+	kind, _ := schema["type"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := schema["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s has no name", kind)
+		}
+		if ns, ok := schema["namespace"].(string); ok {
+			namespace = ns
+		}
+		fullName := avroFullName(name, namespace)
+		if i := strings.LastIndex(fullName, "."); i >= 0 {
+			namespace = fullName[:i]
+		}
+
+		named := &avroSchema{kind: kind, name: fullName}
+		if kind == "error" {
+			named.kind = "record"
+		}
+		p.named[fullName] = named
+		return named, p.fillNamed(named, schema, namespace)
+
+	case "array":
+		items, err := p.parse(schema["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: "array", items: items}, nil
+
+	case "map":
+		values, err := p.parse(schema["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: "map", items: values}, nil
+	}
+
+	// A primitive written as {"type": "long"}, possibly with a logical type
+	return p.parse(schema["type"], namespace)
+}
+
+func (p avroSchemaParser) fillNamed(named *avroSchema, schema map[string]interface{}, namespace string) error {
+	switch named.kind {
+	case "record":
+		fields, _ := schema["fields"].([]interface{})
+		for _, rawField := range fields {
+			field, _ := rawField.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if name == "" {
+				return fmt.Errorf("record %s has a field with no name", named.name)
+			}
+			fieldSchema, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return fmt.Errorf("field %s.%s: %s", named.name, name, err.Error())
+			}
+			named.fields = append(named.fields, avroField{name: name, schema: fieldSchema})
+		}
+
+	case "enum":
+		symbols, _ := schema["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			name, _ := symbol.(string)
+			named.symbols = append(named.symbols, name)
+		}
+
+	case "fixed":
+		size, ok := schema["size"].(json.Number)
+		if !ok {
+			return fmt.Errorf("fixed %s has no size", named.name)
+		}
+		n, err := size.Int64()
+		if err != nil || n < 0 {
+			return fmt.Errorf("fixed %s has invalid size %s", named.name, size)
+		}
+		named.size = int(n)
+	}
+	return nil
+}
+
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroReader decodes Avro binary encoding
+type avroReader struct {
+	data  []byte
+	pos   int
+	items int64 // array and map items read so far
+}
+
+func (r *avroReader) read(schema *avroSchema) (interface{}, error) {
+	switch schema.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.bytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		return r.long()
+	case "float":
+		b, err := r.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return avroFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))), nil
+	case "double":
+		b, err := r.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return avroFloat(math.Float64frombits(binary.LittleEndian.Uint64(b))), nil
+	case "bytes":
+		b, err := r.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		return avroBytes(b), nil
+	case "string":
+		b, err := r.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case "fixed":
+		b, err := r.bytes(schema.size)
+		if err != nil {
+			return nil, err
+		}
+		return avroBytes(b), nil
+	case "enum":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(schema.symbols)) {
+			return nil, fmt.Errorf("enum %s has no symbol %d", schema.name, i)
+		}
+		return schema.symbols[i], nil
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(schema.branches)) {
+			return nil, fmt.Errorf("union has no branch %d", i)
+		}
+		return r.read(schema.branches[i])
+	case "record":
+		record := jsonObject{}
+		for _, field := range schema.fields {
+			value, err := r.read(field.schema)
+			if err != nil {
+				return nil, err
+			}
+			record = append(record, jsonField{name: field.name, value: value})
+		}
+		return record, nil
+	case "array":
+		items := []interface{}{}
+		err := r.blocks(func() error {
+			item, err := r.read(schema.items)
+			items = append(items, item)
+			return err
+		})
+		return items, err
+	case "map":
+		values := make(map[string]interface{})
+		err := r.blocks(func() error {
+			key, err := r.lengthPrefixed()
+			if err != nil {
+				return err
+			}
+			values[string(key)], err = r.read(schema.items)
+			return err
+		})
+		return values, err
+	}
+	return nil, fmt.Errorf("unsupported type %q", schema.kind)
+}
+
+// blocks reads the blocks of an array or map, calling item for each item
+func (r *avroReader) blocks(item func() error) error {
+	for {
+		count, err := r.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the block's size in bytes
+			count = -count
+			if _, err := r.long(); err != nil {
+				return err
+			}
+		}
+		if count < 0 || count > avroMaxItems-r.items {
+			return fmt.Errorf("message has more than the %d array and map items allowed", avroMaxItems)
+		}
+		r.items += count
+		for i := int64(0); i < count; i++ {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long reads a zig-zag encoded variable length integer
+func (r *avroReader) long() (int64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.bytes(1)
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			return int64(value>>1) ^ -int64(value&1), nil
+		}
+	}
+	return 0, fmt.Errorf("variable length integer is too long")
+}
+
+func (r *avroReader) lengthPrefixed() ([]byte, error) {
+	length, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length > int64(len(r.data)-r.pos) {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	return r.bytes(int(length))
+}
+
+func (r *avroReader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, fmt.Errorf("message ends before its schema does")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// avroBytes returns bytes as a string with one code point per byte, as Avro's JSON encoding does
+func avroBytes(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// avroFloat returns NaN and infinities as strings, since JSON cannot hold them
+func avroFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
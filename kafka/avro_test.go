@@ -0,0 +1,50 @@
+package client
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// avroLong zig-zag encodes n as Avro writes int and long values
+func avroLong(n int64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutVarint(b, n)]
+}
+
+func TestAvroReaderLimits(t *testing.T) {
+	nulls := &avroSchema{kind: "array", items: &avroSchema{kind: "null"}}
+
+	// Blocks under the limit together, then over it
+	var data []byte
+	for i := 0; i < 4; i++ {
+		data = append(data, avroLong(avroMaxItems/4)...)
+	}
+	data = append(data, 0)
+	r := &avroReader{data: data}
+	if items, err := r.read(nulls); err != nil || len(items.([]interface{})) != avroMaxItems {
+		t.Errorf("reading %d nulls: %v", avroMaxItems, err)
+	}
+	data = append(avroLong(1), data...)
+	r = &avroReader{data: data}
+	if _, err := r.read(nulls); err == nil {
+		t.Errorf("read %d nulls, want an error", avroMaxItems+1)
+	}
+
+	// Counts that don't fit once negated
+	r = &avroReader{data: append(avroLong(math.MinInt64), 0)}
+	if _, err := r.read(nulls); err == nil {
+		t.Errorf("read a block of %d items, want an error", int64(math.MinInt64))
+	}
+
+	// Sizes past the end of the message
+	maxInt := int(^uint(0) >> 1)
+	r = &avroReader{data: []byte{1, 2, 3}, pos: 1}
+	if _, err := r.read(&avroSchema{kind: "fixed", size: maxInt}); err == nil {
+		t.Errorf("read a fixed of %d bytes, want an error", maxInt)
+	}
+	r = &avroReader{data: append(avroLong(math.MaxInt64), 1, 2)}
+	if _, err := r.read(&avroSchema{kind: "string"}); err == nil {
+		t.Errorf("read a string of %d bytes, want an error", int64(math.MaxInt64))
+	}
+}
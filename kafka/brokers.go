@@ -0,0 +1,230 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eapache/go-resiliency/breaker"
+	"github.com/shopify/sarama"
+)
+
+// Breaker settings for each broker connection: open after 3 failed requests
+// in a row, then wait 10 seconds before trying to reconnect
+const (
+	brokerErrorThreshold   = 3
+	brokerSuccessThreshold = 1
+	brokerRetryTimeout     = 10 * time.Second
+)
+
+// brokerPool holds a connection to every broker we know of, from the bootstrap
+// list and from metadata responses. Requests go to the first broker that
+// answers, and each broker sits behind a circuit breaker so a dead one is
+// skipped and reconnected with back off instead of failing every request.
+type brokerPool struct {
+	lock    sync.Mutex
+	brokers []*pooledBroker
+	leaders map[topicPartition]string // each partition's leader, from the last metadata response listing it, or "" if it had none
+}
+
+type pooledBroker struct {
+	addr    string
+	breaker *breaker.Breaker
+
+	lock      sync.Mutex
+	broker    *sarama.Broker
+	state     string
+	lastError string
+	since     time.Time
+}
+
+// BrokerStatus is the breaker state of a broker connection.
+// State is closed (working), failing (errors but still tried) or open (skipped until retried).
+type BrokerStatus struct {
+	Addr      string    `json:"addr"`
+	State     string    `json:"state"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+func newBrokerPool(addrs []string) *brokerPool {
+	pool := &brokerPool{leaders: make(map[topicPartition]string)}
+	for _, addr := range addrs {
+		pool.add(addr)
+	}
+	return pool
+}
+
+func (p *brokerPool) add(addr string) {
+	p.get(addr)
+}
+
+// get returns the pool's connection to the broker at addr, adding it if it is new
+func (p *brokerPool) get(addr string) *pooledBroker {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, pooled := range p.brokers {
+		if pooled.addr == addr {
+			return pooled
+		}
+	}
+	pooled := &pooledBroker{
+		addr:    addr,
+		breaker: breaker.New(brokerErrorThreshold, brokerSuccessThreshold, brokerRetryTimeout),
+		state:   "closed",
+		since:   time.Now(),
+	}
+	p.brokers = append(p.brokers, pooled)
+	return pooled
+}
+
+// learn adds the brokers from a metadata response to the pool, and notes
+// the leader of each partition it lists
+func (p *brokerPool) learn(response *sarama.MetadataResponse) {
+	addrs := make(map[int32]string)
+	for _, broker := range response.Brokers {
+		p.add(broker.Addr())
+		addrs[broker.ID()] = broker.Addr()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, topic := range response.Topics {
+		if topic.Err != sarama.ErrNoError {
+			continue
+		}
+		for _, partition := range topic.Partitions {
+			p.leaders[topicPartition{topic.Name, partition.ID}] = addrs[partition.Leader]
+		}
+	}
+}
+
+// leader returns the address of the partition's leader, and whether a
+// metadata response has listed the partition
+func (p *brokerPool) leader(topic string, partition int32) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	addr, ok := p.leaders[topicPartition{topic, partition}]
+	return addr, ok
+}
+
+// do runs a request against each broker in turn until one succeeds,
+// returning the last error if none do
+func (p *brokerPool) do(request func(*sarama.Broker) error) error {
+	p.lock.Lock()
+	brokers := append([]*pooledBroker(nil), p.brokers...)
+	p.lock.Unlock()
+
+	err := error(breaker.ErrBreakerOpen)
+	for _, pooled := range brokers {
+		err = pooled.do(request)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// doOn runs a request against one broker, such as a partition's leader
+func (p *brokerPool) doOn(addr string, request func(*sarama.Broker) error) error {
+	return p.get(addr).do(request)
+}
+
+func (p *brokerPool) status() []BrokerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := make([]BrokerStatus, len(p.brokers))
+	for i, pooled := range p.brokers {
+		pooled.lock.Lock()
+		status[i] = BrokerStatus{
+			Addr:      pooled.addr,
+			State:     pooled.state,
+			LastError: pooled.lastError,
+			Since:     pooled.since,
+		}
+		pooled.lock.Unlock()
+	}
+	return status
+}
+
+func (p *brokerPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, pooled := range p.brokers {
+		pooled.disconnect()
+	}
+}
+
+func (pb *pooledBroker) do(request func(*sarama.Broker) error) error {
+	err := pb.breaker.Run(func() error {
+		broker, err := pb.connect()
+		if err != nil {
+			return err
+		}
+
+		err = request(broker)
+		if err != nil {
+			// Start with a fresh connection on the next attempt
+			pb.disconnect()
+		}
+		return err
+	})
+
+	pb.setState(err)
+	return err
+}
+
+func (pb *pooledBroker) connect() (*sarama.Broker, error) {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	if pb.broker != nil {
+		return pb.broker, nil
+	}
+
+	broker := sarama.NewBroker(pb.addr)
+	err := broker.Open(nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := broker.Connected(); err != nil {
+		broker.Close()
+		return nil, err
+	}
+
+	pb.broker = broker
+	return broker, nil
+}
+
+func (pb *pooledBroker) disconnect() {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	if pb.broker != nil {
+		pb.broker.Close()
+		pb.broker = nil
+	}
+}
+
+func (pb *pooledBroker) setState(err error) {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	state := "closed"
+	switch {
+	case err == breaker.ErrBreakerOpen:
+		state = "open"
+	case err != nil:
+		state = "failing"
+		pb.lastError = err.Error()
+	}
+
+	if state != pb.state {
+		pb.state = state
+		pb.since = time.Now()
+	}
+}
@@ -0,0 +1,311 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/shopify/sarama"
+)
+
+// How many bulk messages may wait on broker acks at once,
+// and how many failures are listed in a bulk summary
+const (
+	bulkInFlight    = 256
+	bulkMaxFailures = 100
+)
+
+// BulkFormat is how an uploaded file is split into messages.
+type BulkFormat struct {
+	Type        string // ndjson, csv or lines
+	KeyColumn   string // csv column used as the message key
+	ValueColumn string // csv column used as the message value, instead of the whole row as JSON
+}
+
+// BulkSummary is the outcome of a bulk produce.
+type BulkSummary struct {
+	Topic      string                   `json:"topic"`
+	Read       int                      `json:"read"`
+	Produced   int                      `json:"produced"`
+	Failed     int                      `json:"failed"`
+	Partitions map[int32]*ProducedRange `json:"partitions"`
+	Failures   []BulkFailure            `json:"failures"` // the first failures, up to 100
+}
+
+// ProducedRange is the span of offsets a bulk produce wrote to a partition.
+type ProducedRange struct {
+	Count       int   `json:"count"`
+	FirstOffset int64 `json:"first_offset"`
+	LastOffset  int64 `json:"last_offset"`
+}
+
+type BulkFailure struct {
+	Line           int    `json:"line"`
+	Error          string `json:"error"`
+	KafkaErrorCode *int16 `json:"kafka_error_code,omitempty"`
+}
+
+// bulkMessage is one message read from an upload, with the line it came from
+type bulkMessage struct {
+	line      int
+	key       []byte
+	partition int32
+	value     []byte
+	err       error
+}
+
+// ProduceBulk streams the messages in r to the topic. Key and partition
+// fields read from the file override those in options. Messages that cannot
+// be read or produced are counted as failures and do not stop the upload.
+func (kc KafkaConfig) ProduceBulk(topic string, r io.Reader, format BulkFormat, options ProduceOptions) (*BulkSummary, error) {
+	numPartitions, err := kc.partitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan bulkMessage)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(messages)
+		readErr <- readBulkMessages(r, format, messages)
+	}()
+
+	summary := &BulkSummary{
+		Topic:      topic,
+		Partitions: make(map[int32]*ProducedRange),
+		Failures:   []BulkFailure{},
+	}
+
+	// Messages are sent in file order and their acks collected in the same order,
+	// with at most bulkInFlight waiting at once
+	type inFlight struct {
+		line    int
+		pending *pendingMessage
+		err     error
+	}
+	queue := make(chan inFlight, bulkInFlight)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for sent := range queue {
+			if sent.err != nil {
+				summary.record(sent.line, nil, sent.err)
+				continue
+			}
+			produced, err := sent.pending.wait()
+			summary.record(sent.line, produced, err)
+		}
+	}()
+
+	for message := range messages {
+		summary.Read++
+		if message.err != nil {
+			queue <- inFlight{line: message.line, err: message.err}
+			continue
+		}
+
+		messageOptions := options
+		if message.key != nil {
+			messageOptions.Key = message.key
+		}
+		if message.partition >= 0 {
+			messageOptions.Partition = message.partition
+		}
+
+		pending, err := kc.send(sarama.ByteEncoder(message.value), topic, numPartitions, messageOptions)
+		queue <- inFlight{line: message.line, pending: pending, err: err}
+	}
+	close(queue)
+	<-collected
+
+	if err := <-readErr; err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// record counts a message's result
+func (s *BulkSummary) record(line int, produced *Produced, err error) {
+	if err != nil {
+		s.Failed++
+		if len(s.Failures) < bulkMaxFailures {
+			failure := BulkFailure{Line: line, Error: err.Error()}
+			if code, ok := KafkaErrorCode(err); ok {
+				failure.KafkaErrorCode = &code
+			}
+			s.Failures = append(s.Failures, failure)
+		}
+		return
+	}
+
+	s.Produced++
+	offsets, ok := s.Partitions[produced.Partition]
+	if !ok {
+		offsets = &ProducedRange{FirstOffset: produced.Offset, LastOffset: produced.Offset}
+		s.Partitions[produced.Partition] = offsets
+	}
+	offsets.Count++
+	if produced.Offset >= 0 && produced.Offset < offsets.FirstOffset {
+		offsets.FirstOffset = produced.Offset
+	}
+	if produced.Offset > offsets.LastOffset {
+		offsets.LastOffset = produced.Offset
+	}
+}
+
+func readBulkMessages(r io.Reader, format BulkFormat, messages chan bulkMessage) error {
+	switch format.Type {
+	case "", "lines":
+		return readLines(r, messages, func(line []byte) bulkMessage {
+			return bulkMessage{partition: -1, value: line}
+		})
+	case "ndjson":
+		return readLines(r, messages, parseNDJSONLine)
+	case "csv":
+		return readCSV(r, format, messages)
+	}
+	return fmt.Errorf("invalid format %q, expected ndjson, csv or lines", format.Type)
+}
+
+// readLines sends a message for every non-blank line of r
+func readLines(r io.Reader, messages chan bulkMessage, parse func([]byte) bulkMessage) error {
+	reader := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(bytes.TrimSpace(line)) > 0 {
+			message := parse(line)
+			message.line = lineNum
+			messages <- message
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseNDJSONLine reads a JSON object. If it has a value field, that is the message,
+// with optional key and partition fields. Otherwise the whole line is the message.
+func parseNDJSONLine(line []byte) bulkMessage {
+	message := bulkMessage{partition: -1, value: line}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(line, &fields)
+	if err != nil {
+		message.err = fmt.Errorf("invalid JSON: %s", err.Error())
+		return message
+	}
+
+	value, ok := fields["value"]
+	if !ok {
+		return message
+	}
+	message.value = rawJSONText(value)
+
+	if key, ok := fields["key"]; ok && string(key) != "null" {
+		message.key = rawJSONText(key)
+	}
+
+	if partition, ok := fields["partition"]; ok {
+		err := json.Unmarshal(partition, &message.partition)
+		if err != nil || message.partition < 0 {
+			message.err = fmt.Errorf("invalid partition %s", partition)
+		}
+	}
+	return message
+}
+
+// rawJSONText returns the contents of a JSON string, or the JSON itself for any other value
+func rawJSONText(raw json.RawMessage) []byte {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []byte(text)
+	}
+	return raw
+}
+
+// readCSV sends a message for every row after the header. The value is the row as a
+// JSON object keyed by the header, or a single column if ValueColumn is set.
+func readCSV(r io.Reader, format BulkFormat, messages chan bulkMessage) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keyIndex, valueIndex := -1, -1
+	for i, column := range header {
+		if format.KeyColumn != "" && column == format.KeyColumn {
+			keyIndex = i
+		}
+		if format.ValueColumn != "" && column == format.ValueColumn {
+			valueIndex = i
+		}
+	}
+	if format.KeyColumn != "" && keyIndex < 0 {
+		return fmt.Errorf("key column %q is not in the CSV header", format.KeyColumn)
+	}
+	if format.ValueColumn != "" && valueIndex < 0 {
+		return fmt.Errorf("value column %q is not in the CSV header", format.ValueColumn)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			messages <- bulkMessage{line: parseErr.StartLine, partition: -1, err: err}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// A quoted field may span lines, so the row's line is where it starts
+		line, _ := reader.FieldPos(0)
+		message := bulkMessage{line: line, partition: -1}
+		if len(record) != len(header) {
+			message.err = fmt.Errorf("row has %d columns, header has %d", len(record), len(header))
+		} else {
+			if keyIndex >= 0 {
+				message.key = []byte(record[keyIndex])
+			}
+			if valueIndex >= 0 {
+				message.value = []byte(record[valueIndex])
+			} else {
+				message.value, message.err = csvRowJSON(header, record)
+			}
+		}
+		messages <- message
+	}
+}
+
+// csvRowJSON writes a row as a JSON object with the header's columns in order.
+// A column named twice takes its last value, at its first position.
+func csvRowJSON(header []string, record []string) ([]byte, error) {
+	row := make(jsonObject, 0, len(header))
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		if j, ok := columns[column]; ok {
+			row[j].value = record[i]
+			continue
+		}
+		columns[column] = len(row)
+		row = append(row, jsonField{name: column, value: record[i]})
+	}
+	return json.Marshal(row)
+}
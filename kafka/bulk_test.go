@@ -0,0 +1,53 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadCSV(t *testing.T) {
+	input := "id,name,note\n" +
+		"1,a,\"spans\ntwo lines\"\n" +
+		"2,b\n" +
+		"3,\"bad\"quote,x\n" +
+		"4,d,\"\"\n"
+	want := []struct {
+		line  int
+		value string
+		err   bool
+	}{
+		{2, `{"id":"1","name":"a","note":"spans\ntwo lines"}`, false},
+		{4, ``, true},
+		{5, ``, true},
+		{6, `{"id":"4","name":"d","note":""}`, false},
+	}
+
+	messages := make(chan bulkMessage)
+	done := make(chan error, 1)
+	go func() {
+		done <- readCSV(strings.NewReader(input), BulkFormat{Type: "csv"}, messages)
+		close(messages)
+	}()
+	var got []bulkMessage
+	for message := range messages {
+		got = append(got, message)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("readCSV: %s", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("read %d messages, want %d", len(got), len(want))
+	}
+	for i, message := range got {
+		if message.line != want[i].line {
+			t.Errorf("message %d on line %d, want %d", i, message.line, want[i].line)
+		}
+		if (message.err != nil) != want[i].err {
+			t.Errorf("message %d on line %d: error %v", i, message.line, message.err)
+		}
+		if message.err == nil && string(message.value) != want[i].value {
+			t.Errorf("message %d on line %d = %s, want %s", i, message.line, message.value, want[i].value)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/shopify/sarama"
+)
+
+// DefaultMessageCacheSize is how many bytes of messages are cached unless set otherwise.
+const DefaultMessageCacheSize = 64 << 20
+
+// Rough bytes each cached message costs beyond its data: the entry, list
+// element, map slots and decoded value headers
+const cacheEntryOverhead = 256
+
+// messageCache keeps recently read messages, with their decoded values, so
+// paging and searching over the same offsets don't refetch them. Offsets are
+// immutable, so an entry is only invalid once retention deletes its offset,
+// or if the decoders change, which only drops the decoded values.
+type messageCache struct {
+	lock       sync.Mutex
+	maxBytes   int64
+	bytes      int64
+	recent     *list.List // of *cacheEntry, most recently used first
+	entries    map[cacheKey]*list.Element
+	partitions map[cachePartition]*cachedPartition
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	invalidated int64
+}
+
+type cachePartition struct {
+	topic     string
+	partition int32
+}
+
+type cacheKey struct {
+	cachePartition
+	offset int64
+}
+
+// cachedPartition indexes a partition's entries, so retention can drop them
+type cachedPartition struct {
+	offsets  map[int64]*list.Element
+	earliest int64 // no entry is below this offset
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	message    *sarama.ConsumerMessage
+	value      *DecodedValue
+	decodedKey *DecodedValue
+	generation uint64 // of the decoders that made value and decodedKey
+	size       int64
+}
+
+// CacheStats describe how well the message cache is doing.
+type CacheStats struct {
+	Entries     int     `json:"entries"`
+	Bytes       int64   `json:"bytes"`
+	MaxBytes    int64   `json:"max_bytes"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Evictions   int64   `json:"evictions"`   // dropped to make room
+	Invalidated int64   `json:"invalidated"` // dropped because retention deleted their offsets
+}
+
+func newMessageCache(maxBytes int64) *messageCache {
+	return &messageCache{
+		maxBytes:   maxBytes,
+		recent:     list.New(),
+		entries:    make(map[cacheKey]*list.Element),
+		partitions: make(map[cachePartition]*cachedPartition),
+	}
+}
+
+// get returns the cached message at an offset as a filter input, with the
+// decoded value and key filled in if the decoders haven't changed since.
+func (c *messageCache) get(topic string, partition int32, offset int64, decoders *DecoderRegistry) (*filterInput, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[cacheKey{cachePartition{topic, partition}, offset}]
+	if !ok {
+		return nil, false
+	}
+	c.hits++
+	c.recent.MoveToFront(element)
+
+	entry := element.Value.(*cacheEntry)
+	input := &filterInput{topic: topic, message: entry.message, decoders: decoders, cached: true}
+	if entry.generation == decoders.Generation() {
+		input.value = entry.value
+		input.key = entry.decodedKey
+	}
+	return input, true
+}
+
+// miss counts a message that had to be fetched from a broker
+func (c *messageCache) miss() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.misses++
+}
+
+// put caches a message with whatever of it the input has decoded
+func (c *messageCache) put(input *filterInput) {
+	message := input.message
+	if !input.cached {
+		// A fetched key and value are slices of the whole fetch response, which
+		// would stay in memory as long as they did, so cache copies of them
+		message = &sarama.ConsumerMessage{
+			Topic:     message.Topic,
+			Partition: message.Partition,
+			Key:       copyBytes(message.Key),
+			Value:     copyBytes(message.Value),
+			Offset:    message.Offset,
+		}
+	}
+	entry := &cacheEntry{
+		key:        cacheKey{cachePartition{message.Topic, message.Partition}, message.Offset},
+		message:    message,
+		value:      input.value,
+		decodedKey: input.key,
+		generation: input.decoders.Generation(),
+	}
+	entry.size = cacheEntryOverhead + int64(len(message.Topic)+len(message.Key)+len(message.Value))
+	for _, decoded := range []*DecodedValue{entry.value, entry.decodedKey} {
+		if decoded != nil {
+			entry.size += int64(len(decoded.Message) + len(decoded.Decoder) + len(decoded.Raw) + len(decoded.DecodeError))
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry.size > c.maxBytes {
+		return
+	}
+
+	cached := c.partitions[entry.key.cachePartition]
+	if cached != nil && entry.key.offset < cached.earliest {
+		return
+	}
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+
+	if cached == nil {
+		cached = &cachedPartition{offsets: make(map[int64]*list.Element)}
+		c.partitions[entry.key.cachePartition] = cached
+	}
+	element := c.recent.PushFront(entry)
+	c.entries[entry.key] = element
+	cached.offsets[entry.key.offset] = element
+	c.bytes += entry.size
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.recent.Back())
+		c.evictions++
+	}
+}
+
+// copyBytes copies data, keeping nil apart from empty so tombstones stay tombstones
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+// retain drops a partition's messages below earliest, which retention has deleted
+func (c *messageCache) retain(topic string, partition int32, earliest int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached := c.partitions[cachePartition{topic, partition}]
+	if cached == nil || earliest <= cached.earliest {
+		return
+	}
+	cached.earliest = earliest
+	for offset, element := range cached.offsets {
+		if offset < earliest {
+			c.remove(element)
+			c.invalidated++
+		}
+	}
+}
+
+// remove drops an entry; the caller holds the lock
+func (c *messageCache) remove(element *list.Element) {
+	entry := c.recent.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if cached := c.partitions[entry.key.cachePartition]; cached != nil {
+		delete(cached.offsets, entry.key.offset)
+	}
+	c.bytes -= entry.size
+}
+
+func (c *messageCache) resize(maxBytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxBytes = maxBytes
+	for c.bytes > c.maxBytes && c.recent.Len() > 0 {
+		c.remove(c.recent.Back())
+		c.evictions++
+	}
+}
+
+func (c *messageCache) stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := CacheStats{
+		Entries:     len(c.entries),
+		Bytes:       c.bytes,
+		MaxBytes:    c.maxBytes,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Invalidated: c.invalidated,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		stats.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
+
+// SetCacheSize bounds the bytes of messages cached, 0 to turn the cache off.
+func (kc KafkaConfig) SetCacheSize(maxBytes int64) {
+	kc.cache.resize(maxBytes)
+}
+
+// CacheStats reports the message cache's size and hit rate.
+func (kc KafkaConfig) CacheStats() CacheStats {
+	return kc.cache.stats()
+}
@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
-	"regexp"
-	"sync"
 	"time"
 
 	"github.com/shopify/sarama"
@@ -18,34 +16,34 @@ type MetadataResponse struct {
 type KafkaConfig struct {
 	// binDir    string
 	// configDir string
-	broker   *sarama.Broker
-	client   *sarama.Client
-	producer *sarama.Producer
+	brokers   *brokerPool
+	client    *sarama.Client
+	producers *producerSet
+	decoders  *DecoderRegistry
+	fetches   chan struct{} // a slot for each fetch request in flight
+	cache     *messageCache
+
+	lagHistory *lagHistory
 }
 
-func NewKafka(kafkaHost string, kafkaPort string) (*KafkaConfig, error) {
-	kc := KafkaConfig{}
+// NewKafka connects to the cluster through the given bootstrap brokers (host:port).
+// Brokers found in later metadata responses are used as well, so the bootstrap
+// brokers only need to be up at start.
+func NewKafka(brokers []string) (*KafkaConfig, error) {
+	kc := KafkaConfig{lagHistory: newLagHistory(), decoders: NewDecoderRegistry(), fetches: make(chan struct{}, fetchConcurrency), cache: newMessageCache(DefaultMessageCacheSize)}
 	// kc.binDir = conf.kafkaBinDir
 	// kc.configDir = conf.kafkaConfigDir
 
-	broker := kafkaHost + ":" + kafkaPort
 	//zookeeper = 2181
-	kc.broker = sarama.NewBroker(broker)
-	err := kc.broker.Open(nil)
-	if err != nil {
-		return nil, err
-	}
+	kc.brokers = newBrokerPool(brokers)
 
-	kc.client, err = sarama.NewClient([]string{broker}, sarama.NewConfig())
+	var err error
+	kc.client, err = sarama.NewClient(brokers, sarama.NewConfig())
 	if err != nil {
 		return nil, err
 	}
 
-	producer, err := sarama.NewProducerFromClient(kc.client)
-	if err != nil {
-		return nil, err
-	}
-	kc.producer = &producer
+	kc.producers = newProducerSet(brokers)
 
 	return &kc, nil
 }
@@ -68,7 +66,10 @@ func NewKafka(kafkaHost string, kafkaPort string) (*KafkaConfig, error) {
              "replication" : 5,
              "paritions" : 1,
              "partition_info" : [
-                   {"length": 103}
+                   {"length": 103, "id": 0, "leader": 2,
+                    "earliest": 40, "latest": 103, "retained": 63,
+                    "replicas": [2, 3, 4, 5, 1], "isr": [2, 3, 5],
+                    "under_replicated": true}
              ]
            }
        ]
@@ -80,162 +81,193 @@ func (kc KafkaConfig) Metadata(topics []string) ([]TopicMetadata, error) {
 		request.Topics = topics
 	}
 
-	response, err := kc.broker.GetMetadata(&request)
+	response, err := kc.getMetadata(&request)
 	if err != nil {
 		return nil, err
 	}
 
+	offsets := kc.leaderOffsets(response, sarama.EarliestOffset, sarama.LatestOffsets)
+
 	metadata := make([]TopicMetadata, len(response.Topics))
 	for i, topic := range response.Topics {
 		metadata[i].Name = topic.Name
 		metadata[i].Partitions = len(topic.Partitions)
 		metadata[i].Partition_info = make([]partitionMetadata, len(topic.Partitions))
-		replicationFactor, err := kc.TopicReplicationFactor(topic.Name, 0)
-		if err != nil {
-			return nil, err
-		}
-		metadata[i].Replication = replicationFactor
 		for j, partition := range topic.Partitions {
-			partitionInfo, err := kc.PartitionMetadata(topic.Name, partition.ID)
-			if err != nil {
-				return nil, err
+			partitionInfo := partitionMetadata{
+				Id:              partition.ID,
+				Leader:          partition.Leader,
+				Replicas:        partition.Replicas,
+				Isr:             partition.Isr,
+				UnderReplicated: len(partition.Isr) < len(partition.Replicas),
+			}
+			bounds := offsets[topicPartition{topic.Name, partition.ID}]
+			if bounds.err != nil {
+				partitionInfo.OffsetError = bounds.err.Error()
+			} else {
+				earliest, latest := bounds.offsets[0], bounds.offsets[1]
+				kc.cache.retain(topic.Name, partition.ID, earliest)
+				partitionInfo.Length = latest
+				partitionInfo.Earliest = earliest
+				partitionInfo.Latest = latest
+				partitionInfo.Retained = latest - earliest
+			}
+			metadata[i].Partition_info[j] = partitionInfo
+
+			// Partitions can differ while replicas are being reassigned
+			if len(partition.Replicas) > metadata[i].Replication {
+				metadata[i].Replication = len(partition.Replicas)
 			}
-			metadata[i].Partition_info[j] = *partitionInfo
 		}
 	}
 	return metadata, nil
 }
 
-type partitionMetadata struct {
-	Length int64 `json:"length"`
-	Id     int32 `json:"id"`
+// getMetadata sends a metadata request to any live broker,
+// adding the brokers it lists to the ones we can use
+func (kc KafkaConfig) getMetadata(request *sarama.MetadataRequest) (*sarama.MetadataResponse, error) {
+	var response *sarama.MetadataResponse
+	err := kc.brokers.do(func(broker *sarama.Broker) (err error) {
+		response, err = broker.GetMetadata(request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kc.brokers.learn(response)
+	return response, nil
 }
 
-// Sarama requires a partition?
-func (kc KafkaConfig) TopicReplicationFactor(topic string, partition int32) (int, error) {
-	replicaIDs, err := kc.client.Replicas(topic, partition)
-	if err != nil {
-		return -1, err
+// leader returns the address of the partition's leader, asking for the
+// topic's metadata if no response has named one yet
+func (kc KafkaConfig) leader(topic string, partition int32) (string, error) {
+	if addr, _ := kc.brokers.leader(topic, partition); addr != "" {
+		return addr, nil
 	}
-	return len(replicaIDs), nil
 
+	err := kc.refreshMetadata(topic)
+	if err != nil {
+		return "", err
+	}
+	addr, ok := kc.brokers.leader(topic, partition)
+	switch {
+	case !ok:
+		return "", sarama.ErrUnknownTopicOrPartition
+	case addr == "":
+		return "", sarama.ErrLeaderNotAvailable
+	}
+	return addr, nil
 }
 
-func (kc KafkaConfig) PartitionMetadata(topic string, partition int32) (*partitionMetadata, error) {
-	latestOffset, err := kc.client.GetOffset(topic, partition, sarama.LatestOffsets)
+// refreshMetadata asks for a topic's metadata, so the pool learns where its
+// partitions' leaders are now
+func (kc KafkaConfig) refreshMetadata(topic string) error {
+	response, err := kc.getMetadata(&sarama.MetadataRequest{Topics: []string{topic}})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for _, t := range response.Topics {
+		if t.Name == topic && t.Err != sarama.ErrNoError {
+			return t.Err
+		}
+	}
+	return nil
+}
 
-	return &partitionMetadata{Length: latestOffset, Id: partition}, nil
+// Decoders returns the registry used to decode consumed and searched messages.
+func (kc KafkaConfig) Decoders() *DecoderRegistry {
+	return kc.decoders
 }
 
-func (kc KafkaConfig) Produce(message string, topic string) {
-	(*kc.producer).Input() <- &sarama.ProducerMessage{Topic: topic, Key: nil, Value: sarama.StringEncoder(message)}
+// BrokerStatus reports the circuit breaker state of every known broker.
+func (kc KafkaConfig) BrokerStatus() []BrokerStatus {
+	return kc.brokers.status()
 }
 
-type kafkaMessage struct {
-	Offset  int64  `json:"offset"`
-	Message string `json:"message"`
+type partitionMetadata struct {
+	Length          int64   `json:"length"` // same as Latest, kept for older clients
+	Id              int32   `json:"id"`
+	Earliest        int64   `json:"earliest"` // oldest offset not yet removed by retention
+	Latest          int64   `json:"latest"`   // offset the next message will get
+	Retained        int64   `json:"retained"` // messages still held by the partition
+	Leader          int32   `json:"leader"`   // -1 if the partition has no leader
+	Replicas        []int32 `json:"replicas"`
+	Isr             []int32 `json:"isr"`
+	UnderReplicated bool    `json:"under_replicated"`
+	OffsetError     string  `json:"offset_error,omitempty"` // why the offsets couldn't be read, if they couldn't
 }
 
-func (kc KafkaConfig) SearchTopic(found chan MessageMatch, stopSearch chan struct{}, topic string, keyword string) {
-	topicMetadata, err := kc.Metadata([]string{topic})
+// Sarama requires a partition?
+func (kc KafkaConfig) TopicReplicationFactor(topic string, partition int32) (int, error) {
+	replicaIDs, err := kc.client.Replicas(topic, partition)
 	if err != nil {
-		return
-	}
-
-	var wg sync.WaitGroup
-	for _, partition := range topicMetadata[0].Partition_info {
-		wg.Add(1)
-		go func(partition int32) {
-			defer wg.Done()
-			kc.SearchPartition(found, stopSearch, keyword, topic, partition)
-		}(partition.Id)
+		return -1, err
 	}
+	return len(replicaIDs), nil
 
-	wg.Wait()
 }
 
-type MessageMatch struct {
-	Keyword   string `json:"keyword"`
-	Message   string `json:"message"`
-	Topic     string `json:"topic"`
-	Partition int32  `json:"partition"`
-	Offset    int64  `json:"offset"`
+func (kc KafkaConfig) Partitions(topic string) ([]int32, error) {
+	return kc.client.Partitions(topic)
 }
 
-func (kc KafkaConfig) SearchPartition(found chan MessageMatch, stopSearch chan struct{}, keyword string, topic string, partition int32) {
-	partitionData, err := kc.PartitionMetadata(topic, partition)
+func (kc KafkaConfig) PartitionMetadata(topic string, partition int32) (*partitionMetadata, error) {
+	earliestOffset, latestOffset, err := kc.OffsetBounds(topic, partition)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return nil, err
 	}
 
-	master, err := sarama.NewConsumerFromClient(kc.client)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+	return &partitionMetadata{
+		Length:   latestOffset,
+		Id:       partition,
+		Earliest: earliestOffset,
+		Latest:   latestOffset,
+		Retained: latestOffset - earliestOffset,
+	}, nil
+}
 
-	consumer, err := master.ConsumePartition(topic, int32(partition), int64(0))
+// OffsetBounds returns the oldest offset still held by the partition
+// and the offset the next message produced to it will get.
+func (kc KafkaConfig) OffsetBounds(topic string, partition int32) (int64, int64, error) {
+	offsets, err := kc.offsetsAt(topic, partition, sarama.EarliestOffset, sarama.LatestOffsets)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return -1, -1, err
 	}
-	defer consumer.Close()
 
-	var i int64
-	for i = 0; i < partitionData.Length-1; i++ {
-		select {
-		case message := <-consumer.Messages():
-			match, err := regexp.Match(keyword, message.Value)
-			if err != nil {
-				fmt.Println(err.Error())
-			}
-			if match {
-				found <- MessageMatch{
-					Keyword:   keyword,
-					Message:   string(message.Value[:]),
-					Topic:     topic,
-					Partition: partition,
-					Offset:    message.Offset,
-				}
-			}
-		case err = <-consumer.Errors():
-			fmt.Println(err.Error())
-			return
-		case <-stopSearch:
-			return
-		}
-	}
+	earliestOffset, latestOffset := offsets[0], offsets[1]
+	kc.cache.retain(topic, partition, earliestOffset)
+	return earliestOffset, latestOffset, nil
 }
 
-func (kc KafkaConfig) ConsumeOffsets(offset int, offsetCount int, topic string, partition int) ([]kafkaMessage, error) {
-
-	master, err := sarama.NewConsumerFromClient(kc.client)
-	if err != nil {
-		return nil, err
-	}
-
-	consumer, err := master.ConsumePartition(topic, int32(partition), int64(offset))
-	if err != nil {
-		return nil, err
-	}
+type kafkaMessage struct {
+	Offset int64         `json:"offset"`
+	Key    *DecodedValue `json:"key,omitempty"`
+	DecodedValue
+}
 
-	result := make([]kafkaMessage, offsetCount)
-	var value string
-	for i := 0; i < offsetCount; i++ {
-		select {
-		case message := <-consumer.Messages():
-			value = string(message.Value[:])
-			result[i] = kafkaMessage{Message: value, Offset: message.Offset}
-		case err := <-consumer.Errors():
-			return nil, err
-		}
+// ConsumeOffsets returns the messages of a partition from offset up to
+// offset+offsetCount. It returns fewer if the log ends first, and those read
+// so far with ErrFetchTimeout if the range isn't read within timeout.
+func (kc KafkaConfig) ConsumeOffsets(offset int, offsetCount int, topic string, partition int, timeout time.Duration) ([]kafkaMessage, error) {
+	stop := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(stop) })
+	defer timer.Stop()
+
+	result := []kafkaMessage{}
+	end := int64(offset) + int64(offsetCount)
+	next, err := kc.fetchRange(topic, int32(partition), int64(offset), end, stop, func(input *filterInput) bool {
+		result = append(result, kafkaMessage{
+			Offset:       input.message.Offset,
+			Key:          input.decodedKey(),
+			DecodedValue: *input.decodedValue(),
+		})
+		return true
+	})
+	if err == nil && next < end && !timer.Stop() {
+		err = ErrFetchTimeout
 	}
-	return result, nil
-
+	return result, err
 }
 
 // Returns metadata about kafka
@@ -247,9 +279,9 @@ type TopicMetadata struct {
 }
 
 func (kc KafkaConfig) Close() {
-	kc.broker.Close()
+	kc.producers.close()
+	kc.brokers.close()
 	kc.client.Close()
-	(*kc.producer).Close()
 
 	/*
 		zkCmd = exec.Command("/bin/sh", "-c", kc.binDir+"/zookeeper-server-stop.sh "+kc.configDir+"/zookeeper.properties")
@@ -266,29 +298,31 @@ func (kc KafkaConfig) Close() {
 	*/
 }
 
-func (kc KafkaConfig) Poll(topic string, topicDataChan chan string, closeChan chan struct{}) {
-	ticker := time.NewTicker(time.Millisecond * 1000)
-	go func() {
-		for _ = range ticker.C {
-			metadataResponse, err := kc.TopicDataResponse([]string{topic})
-			if err != nil {
-				fmt.Printf("Error polling topic for metadata: %s", err.Error())
-				return
-			}
+// Poll sends the topic's metadata on topicDataChan every interval until
+// closeChan is closed.
+func (kc KafkaConfig) Poll(topic string, interval time.Duration, topicDataChan chan string, closeChan chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-			topicDataChan <- string(metadataResponse[:])
+	for {
+		select {
+		case <-ticker.C:
+		case <-closeChan:
+			return
+		}
 
-			// Return if closeChan has an item
-			select {
-			case <-closeChan:
-				return
-			default:
-			}
+		metadataResponse, err := kc.TopicDataResponse([]string{topic})
+		if err != nil {
+			fmt.Printf("Error polling topic for metadata: %s\n", err.Error())
+			continue
 		}
-	}()
-	time.Sleep(time.Millisecond * 2000)
-	ticker.Stop()
-	fmt.Println("Ticker stopped")
+
+		select {
+		case topicDataChan <- string(metadataResponse[:]):
+		case <-closeChan:
+			return
+		}
+	}
 }
 
 func (kc KafkaConfig) TopicDataResponse(topics []string) ([]byte, error) {
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Decoder turns raw message bytes into a readable view.
+type Decoder interface {
+	Name() string
+	// Decode returns the readable form of data, a message key if key is set
+	// and a message value otherwise, or an error if data is not in the
+	// decoder's format.
+	Decode(topic string, key bool, data []byte) (string, error)
+}
+
+// AutoDecoder is the topic setting that picks a decoder per message.
+const AutoDecoder = "auto"
+
+// DecodedValue is a message in the form sent to clients: the decoded view,
+// which decoder made it, and the original bytes as base64.
+type DecodedValue struct {
+	Message     string `json:"message"`
+	Decoder     string `json:"decoder"`
+	Raw         string `json:"raw"`
+	DecodeError string `json:"decode_error,omitempty"` // why the topic's decoder failed, if it did
+}
+
+// DecoderRegistry holds the known decoders and which one each topic uses
+// for its keys and values. Topics without a setting use auto-detection.
+type DecoderRegistry struct {
+	lock     sync.RWMutex
+	decoders map[string]Decoder
+	detect   []Decoder // tried in order by auto-detection
+	topics   map[decodeTarget]string
+
+	generation uint64 // counts changes, so values decoded before one can be told apart
+}
+
+// decodeTarget is either the keys or the values of a topic
+type decodeTarget struct {
+	topic string
+	key   bool
+}
+
+func NewDecoderRegistry() *DecoderRegistry {
+	registry := &DecoderRegistry{
+		decoders: make(map[string]Decoder),
+		topics:   make(map[decodeTarget]string),
+	}
+	registry.Register(jsonDecoder{}, true)
+	registry.Register(textDecoder{}, true)
+	registry.Register(hexDecoder{}, false)
+	registry.Register(base64Decoder{}, false)
+	return registry
+}
+
+// Register adds a decoder. Decoders added with detect set are tried by
+// auto-detection, after those already registered.
+func (r *DecoderRegistry) Register(decoder Decoder, detect bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.decoders[decoder.Name()] = decoder
+	r.generation++
+	if detect {
+		r.detect = append(r.detect, decoder)
+	}
+}
+
+// SetTopicDecoder sets the decoder used for a topic's message values, or auto.
+func (r *DecoderRegistry) SetTopicDecoder(topic string, name string) error {
+	return r.setDecoder(decodeTarget{topic: topic}, name)
+}
+
+// SetTopicKeyDecoder sets the decoder used for a topic's message keys, or auto.
+func (r *DecoderRegistry) SetTopicKeyDecoder(topic string, name string) error {
+	return r.setDecoder(decodeTarget{topic: topic, key: true}, name)
+}
+
+func (r *DecoderRegistry) setDecoder(target decodeTarget, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.generation++
+	if name == AutoDecoder {
+		delete(r.topics, target)
+		return nil
+	}
+	if _, ok := r.decoders[name]; !ok {
+		return fmt.Errorf("unknown decoder %q", name)
+	}
+	r.topics[target] = name
+	return nil
+}
+
+// TopicDecoder returns the name of the decoder set for the topic's values, or auto.
+func (r *DecoderRegistry) TopicDecoder(topic string) string {
+	return r.decoderName(decodeTarget{topic: topic})
+}
+
+// TopicKeyDecoder returns the name of the decoder set for the topic's keys, or auto.
+func (r *DecoderRegistry) TopicKeyDecoder(topic string) string {
+	return r.decoderName(decodeTarget{topic: topic, key: true})
+}
+
+func (r *DecoderRegistry) decoderName(target decodeTarget) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if name, ok := r.topics[target]; ok {
+		return name
+	}
+	return AutoDecoder
+}
+
+// Generation changes whenever a decoder is added or a topic's decoder is set.
+func (r *DecoderRegistry) Generation() uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.generation
+}
+
+// Names lists the registered decoders.
+func (r *DecoderRegistry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.decoders))
+	for name := range r.decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decode decodes a message value with the topic's decoder. If that fails, or
+// the topic uses auto-detection, the detection decoders are tried in turn,
+// falling back to a hex dump.
+func (r *DecoderRegistry) Decode(topic string, data []byte) DecodedValue {
+	return r.decode(decodeTarget{topic: topic}, data)
+}
+
+// DecodeKey decodes a message key as Decode does a value. It returns nil for a nil key.
+func (r *DecoderRegistry) DecodeKey(topic string, data []byte) *DecodedValue {
+	if data == nil {
+		return nil
+	}
+	key := r.decode(decodeTarget{topic: topic, key: true}, data)
+	return &key
+}
+
+func (r *DecoderRegistry) decode(target decodeTarget, data []byte) DecodedValue {
+	r.lock.RLock()
+	decoder := r.decoders[r.topics[target]]
+	detect := r.detect
+	r.lock.RUnlock()
+
+	topic := target.topic
+	value := DecodedValue{Raw: base64.StdEncoding.EncodeToString(data)}
+
+	if decoder != nil {
+		message, err := decoder.Decode(topic, target.key, data)
+		if err == nil {
+			value.Message, value.Decoder = message, decoder.Name()
+			return value
+		}
+		value.DecodeError = fmt.Sprintf("%s: %s", decoder.Name(), err.Error())
+	}
+
+	for _, decoder := range detect {
+		message, err := decoder.Decode(topic, target.key, data)
+		if err == nil {
+			value.Message, value.Decoder = message, decoder.Name()
+			return value
+		}
+	}
+
+	value.Message, _ = hexDecoder{}.Decode(topic, target.key, data)
+	value.Decoder = hexDecoder{}.Name()
+	return value
+}
+
+// jsonDecoder pretty prints JSON objects and arrays
+type jsonDecoder struct{}
+
+func (jsonDecoder) Name() string { return "json" }
+
+func (jsonDecoder) Decode(topic string, key bool, data []byte) (string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return "", fmt.Errorf("not a JSON object or array")
+	}
+
+	var pretty bytes.Buffer
+	err := json.Indent(&pretty, trimmed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return pretty.String(), nil
+}
+
+// textDecoder shows UTF-8 text that has no control characters other than whitespace
+type textDecoder struct{}
+
+func (textDecoder) Name() string { return "text" }
+
+func (textDecoder) Decode(topic string, key bool, data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("not valid UTF-8")
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return "", fmt.Errorf("contains control character %U", r)
+		}
+	}
+	return string(data), nil
+}
+
+// hexDecoder shows data as a hex dump, like hexdump -C
+type hexDecoder struct{}
+
+func (hexDecoder) Name() string { return "hex" }
+
+func (hexDecoder) Decode(topic string, key bool, data []byte) (string, error) {
+	return hex.Dump(data), nil
+}
+
+type base64Decoder struct{}
+
+func (base64Decoder) Name() string { return "base64" }
+
+func (base64Decoder) Decode(topic string, key bool, data []byte) (string, error) {
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// jsonObject keeps an object's fields in order when marshalled to JSON,
+// for decoders whose formats define a field order
+type jsonObject []jsonField
+
+type jsonField struct {
+	name  string
+	value interface{}
+}
+
+func (object jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range object {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
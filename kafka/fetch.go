@@ -0,0 +1,175 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// Bounds on reading offset ranges straight from partition leaders
+const (
+	fetchConcurrency = 32                     // fetch requests in flight at once, across all callers
+	fetchBytes       = 64 << 10               // bytes asked of a partition per fetch
+	fetchMaxBytes    = 16 << 20               // most bytes asked for, when a single message is bigger
+	fetchMaxWait     = 500 * time.Millisecond // how long the broker may wait for data
+	fetchRetries     = 3                      // leader moves or broker errors tolerated per range
+)
+
+// ErrFetchTimeout is returned, with the messages read so far, when an offset
+// range isn't read before its timeout.
+var ErrFetchTimeout = errors.New("timed out reading the offset range")
+
+// errFetchStopped ends a fetch whose caller has stopped waiting for it
+var errFetchStopped = errors.New("fetch stopped")
+
+// fetchRange reads a partition from offset up to end, or up to the end of the
+// log if that comes first, passing each message to handle until it returns
+// false. Messages come from the cache, or else from the partition's leader
+// over the pooled broker connections, so nothing is left running once it
+// returns, and it returns as soon as stop is closed. The offset returned is
+// the next one to read. Messages handle accepts are cached with whatever it
+// decoded of them.
+func (kc KafkaConfig) fetchRange(topic string, partition int32, offset int64, end int64, stop <-chan struct{}, handle func(*filterInput) bool) (int64, error) {
+	size := int32(fetchBytes)
+	retries := 0
+	for offset < end {
+		cached, ok := kc.cache.get(topic, partition, offset, kc.decoders)
+		if ok {
+			select {
+			case <-stop:
+				return offset, nil
+			default:
+			}
+			if !handle(cached) {
+				return offset, nil
+			}
+			kc.cache.put(cached)
+			offset++
+			continue
+		}
+
+		block, err := kc.fetch(topic, partition, offset, size, stop)
+		if err == nil && block.Err != sarama.ErrNoError {
+			err = block.Err
+		}
+		switch err {
+		case nil:
+		case errFetchStopped:
+			return offset, nil
+		case sarama.ErrOffsetOutOfRange, sarama.ErrUnknownTopicOrPartition:
+			return offset, err
+		default:
+			// The leader may have moved or its connection failed, so look it up again
+			retries++
+			if retries > fetchRetries {
+				return offset, err
+			}
+			kc.refreshMetadata(topic)
+			continue
+		}
+
+		read := 0
+		for _, messageBlock := range block.MsgSet.Messages {
+			for _, message := range messageBlock.Messages() {
+				// A compressed set is returned whole, so it may start before offset
+				if message.Offset < offset {
+					continue
+				}
+				if message.Offset >= end {
+					return end, nil
+				}
+				consumed := &filterInput{
+					topic: topic,
+					message: &sarama.ConsumerMessage{
+						Topic:     topic,
+						Partition: partition,
+						Key:       message.Msg.Key,
+						Value:     message.Msg.Value,
+						Offset:    message.Offset,
+					},
+					decoders: kc.decoders,
+				}
+				kc.cache.miss()
+				if !handle(consumed) {
+					return offset, nil
+				}
+				kc.cache.put(consumed)
+				offset = message.Offset + 1
+				read++
+			}
+		}
+
+		if offset >= block.HighWaterMarkOffset {
+			return offset, nil
+		}
+		if read > 0 {
+			size = fetchBytes
+			continue
+		}
+
+		// Nothing fit in the fetch, so the next message is bigger than size
+		if !block.MsgSet.PartialTrailingMessage {
+			return offset, sarama.ErrIncompleteResponse
+		}
+		if size >= fetchMaxBytes {
+			return offset, sarama.ErrMessageTooLarge
+		}
+		size *= 2
+	}
+	return offset, nil
+}
+
+type fetchResult struct {
+	block *sarama.FetchResponseBlock
+	err   error
+}
+
+// fetch asks the partition's leader for up to size bytes of messages from
+// offset on. At most fetchConcurrency fetches run at once; one whose caller
+// stops waiting finishes in the background, within the broker read timeout.
+func (kc KafkaConfig) fetch(topic string, partition int32, offset int64, size int32, stop <-chan struct{}) (*sarama.FetchResponseBlock, error) {
+	select {
+	case kc.fetches <- struct{}{}:
+	case <-stop:
+		return nil, errFetchStopped
+	}
+
+	result := make(chan fetchResult, 1)
+	go func() {
+		defer func() { <-kc.fetches }()
+
+		leader, err := kc.leader(topic, partition)
+		if err != nil {
+			result <- fetchResult{err: err}
+			return
+		}
+
+		request := &sarama.FetchRequest{MinBytes: 1, MaxWaitTime: int32(fetchMaxWait / time.Millisecond)}
+		request.AddBlock(topic, partition, offset, size)
+		var response *sarama.FetchResponse
+		err = kc.brokers.doOn(leader, func(broker *sarama.Broker) error {
+			var err error
+			response, err = broker.Fetch(request)
+			return err
+		})
+		if err != nil {
+			result <- fetchResult{err: err}
+			return
+		}
+
+		block := response.GetBlock(topic, partition)
+		if block == nil {
+			result <- fetchResult{err: sarama.ErrIncompleteResponse}
+			return
+		}
+		result <- fetchResult{block: block}
+	}()
+
+	select {
+	case r := <-result:
+		return r.block, r.err
+	case <-stop:
+		return nil, errFetchStopped
+	}
+}
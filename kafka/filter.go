@@ -0,0 +1,694 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/shopify/sarama"
+)
+
+// Filter is a compiled search expression. Conditions compare a field with a value:
+//
+//	value.user.id = 42            JSON path into the decoded value, also written .user.id
+//	key = "order-7"               the whole decoded key; key.a.b is a path into it
+//	value.items[0].sku ~ "^AB"    regular expression on a single field
+//	offset >= 1000                offset and partition are fields too
+//
+// with =, !=, <, <=, >, >= and ~, joined by AND, OR and NOT (or &&, || and !)
+// and grouped with parentheses. A condition that is only a string or word is a
+// regular expression matched against the raw message value, as plain keyword
+// searches always were, and so is a whole filter that isn't an expression but
+// is a regular expression, like a|b.
+type Filter struct {
+	source string
+	root   filterNode
+}
+
+// FilterError is a filter that can't be parsed, and where in it the problem is.
+type FilterError struct {
+	Position int    `json:"position"`
+	Message  string `json:"error"`
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter error at position %d: %s", e.Position, e.Message)
+}
+
+// ParseFilter compiles a filter expression, or else a regular expression
+// matched against raw message values. If it is neither, the error is about
+// the filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	filter, err := parseFilterExpression(expr)
+	if err == nil {
+		return filter, nil
+	}
+	if strings.TrimSpace(expr) == "" {
+		return nil, err
+	}
+	re, reErr := regexp.Compile(expr)
+	if reErr != nil {
+		return nil, err
+	}
+	return &Filter{source: expr, root: &keywordNode{re: re}}, nil
+}
+
+// parseFilterExpression compiles a filter expression, without falling back to
+// a regular expression
+func parseFilterExpression(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != filterEOF {
+		message := fmt.Sprintf("unexpected %q", next.text)
+		if next.kind == filterWord || next.kind == filterString {
+			message += ", quote keywords that contain spaces"
+		}
+		return nil, &FilterError{Position: next.pos, Message: message}
+	}
+	return &Filter{source: expr, root: root}, nil
+}
+
+func (f *Filter) String() string {
+	return f.source
+}
+
+// OffsetRange returns the offsets a message must be within, from start up to
+// but not including end, given the offset conditions that every match must meet.
+func (f *Filter) OffsetRange() (start int64, end int64) {
+	start, end = 0, math.MaxInt64
+	narrowOffsetRange(f.root, &start, &end)
+	return start, end
+}
+
+func narrowOffsetRange(node filterNode, start *int64, end *int64) {
+	switch n := node.(type) {
+	case *andNode:
+		narrowOffsetRange(n.left, start, end)
+		narrowOffsetRange(n.right, start, end)
+	case *compareNode:
+		if n.field.source != "offset" || n.literal.number == "" {
+			return
+		}
+		offset, err := strconv.ParseInt(n.literal.number, 10, 64)
+		if err != nil {
+			return
+		}
+		// The offset after, which can't go past the largest offset
+		after := offset
+		if after < math.MaxInt64 {
+			after++
+		}
+		switch n.op {
+		case "=":
+			*start, *end = maxInt64(*start, offset), minInt64(*end, after)
+		case ">=":
+			*start = maxInt64(*start, offset)
+		case ">":
+			*start = maxInt64(*start, after)
+		case "<":
+			*end = minInt64(*end, offset)
+		case "<=":
+			*end = minInt64(*end, after)
+		}
+	}
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// match reports whether a message passes the filter. Values and keys are
+// only decoded if the filter looks at them.
+func (f *Filter) match(input *filterInput) bool {
+	return f.root.match(input)
+}
+
+// filterInput is a message being filtered, with its decoded forms made on first use
+type filterInput struct {
+	topic    string
+	message  *sarama.ConsumerMessage
+	decoders *DecoderRegistry
+	cached   bool // message is the cache's own copy
+
+	value     *DecodedValue
+	key       *DecodedValue
+	valueJSON *parsedJSON
+	keyJSON   *parsedJSON
+}
+
+type parsedJSON struct {
+	value interface{}
+	ok    bool
+}
+
+func (in *filterInput) decodedValue() *DecodedValue {
+	if in.value == nil {
+		value := in.decoders.Decode(in.topic, in.message.Value)
+		in.value = &value
+	}
+	return in.value
+}
+
+func (in *filterInput) decodedKey() *DecodedValue {
+	if in.key == nil {
+		in.key = in.decoders.DecodeKey(in.topic, in.message.Key)
+	}
+	return in.key
+}
+
+// field looks up a field's value: a string, json.Number, bool, nil, map or
+// slice. It returns false if the message does not have the field.
+func (in *filterInput) field(field filterField) (interface{}, bool) {
+	switch field.source {
+	case "offset":
+		return json.Number(strconv.FormatInt(in.message.Offset, 10)), true
+	case "partition":
+		return json.Number(strconv.FormatInt(int64(in.message.Partition), 10)), true
+	case "key":
+		if in.message.Key == nil {
+			return nil, false
+		}
+		if field.path == nil {
+			return in.decodedKey().Message, true
+		}
+		if in.keyJSON == nil {
+			in.keyJSON = parseFilterJSON(in.decodedKey().Message)
+		}
+		return jsonPath(in.keyJSON, field.path)
+	}
+
+	if field.path == nil {
+		return in.decodedValue().Message, true
+	}
+	if in.valueJSON == nil {
+		in.valueJSON = parseFilterJSON(in.decodedValue().Message)
+	}
+	return jsonPath(in.valueJSON, field.path)
+}
+
+func parseFilterJSON(text string) *parsedJSON {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	parsed := &parsedJSON{}
+	parsed.ok = decoder.Decode(&parsed.value) == nil
+	return parsed
+}
+
+// jsonPath follows path, made of object keys and array indexes, into a parsed JSON value
+func jsonPath(parsed *parsedJSON, path []interface{}) (interface{}, bool) {
+	if !parsed.ok {
+		return nil, false
+	}
+	value := parsed.value
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			value, ok = object[s]
+			if !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || s >= len(array) {
+				return nil, false
+			}
+			value = array[s]
+		}
+	}
+	return value, true
+}
+
+type filterNode interface {
+	match(input *filterInput) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n *andNode) match(input *filterInput) bool {
+	return n.left.match(input) && n.right.match(input)
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n *orNode) match(input *filterInput) bool {
+	return n.left.match(input) || n.right.match(input)
+}
+
+type notNode struct{ node filterNode }
+
+func (n *notNode) match(input *filterInput) bool {
+	return !n.node.match(input)
+}
+
+// keywordNode matches a regular expression against the raw message value
+type keywordNode struct{ re *regexp.Regexp }
+
+func (n *keywordNode) match(input *filterInput) bool {
+	return n.re.Match(input.message.Value)
+}
+
+// filterField is value, key, offset or partition, with a JSON path for value and key
+type filterField struct {
+	source string
+	path   []interface{} // nil for the whole value or key
+}
+
+// filterLiteral is the right hand side of a condition. A number literal keeps its text.
+type filterLiteral struct {
+	text   string
+	number string // set if the literal is a number
+	isBool bool
+	bool   bool
+	isNull bool
+}
+
+type compareNode struct {
+	field   filterField
+	op      string
+	literal filterLiteral
+	re      *regexp.Regexp // for ~
+}
+
+// match is false whenever the message lacks the field, for every operator
+func (n *compareNode) match(input *filterInput) bool {
+	value, ok := input.field(n.field)
+	if !ok {
+		return false
+	}
+
+	if n.op == "~" {
+		return n.re.MatchString(filterText(value))
+	}
+
+	switch {
+	case n.literal.isNull:
+		return compareEquality(n.op, value == nil)
+	case n.literal.isBool:
+		b, ok := value.(bool)
+		return ok && compareEquality(n.op, b == n.literal.bool)
+	case n.literal.number != "":
+		number, ok := value.(json.Number)
+		if !ok {
+			s, isString := value.(string)
+			if !isString {
+				return false
+			}
+			number = json.Number(strings.TrimSpace(s))
+		}
+		cmp, ok := compareNumbers(number, json.Number(n.literal.number))
+		return ok && compareOrder(n.op, cmp)
+	}
+
+	switch value.(type) {
+	case string, json.Number:
+		return compareOrder(n.op, strings.Compare(filterText(value), n.literal.text))
+	}
+	return false
+}
+
+func compareEquality(op string, equal bool) bool {
+	switch op {
+	case "=":
+		return equal
+	case "!=":
+		return !equal
+	}
+	return false
+}
+
+func compareOrder(op string, cmp int) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareNumbers compares as integers when both are, so large offsets and IDs stay exact
+func compareNumbers(a json.Number, b json.Number) (int, bool) {
+	ai, aErr := a.Int64()
+	bi, bErr := b.Int64()
+	if aErr == nil && bErr == nil {
+		switch {
+		case ai < bi:
+			return -1, true
+		case ai > bi:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	af, aErr := a.Float64()
+	bf, bErr := b.Float64()
+	if aErr != nil || bErr != nil {
+		return 0, false
+	}
+	switch {
+	case af < bf:
+		return -1, true
+	case af > bf:
+		return 1, true
+	}
+	return 0, true
+}
+
+// filterText is a field value as text for ~ and string comparisons
+func filterText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	text, _ := json.Marshal(value)
+	return string(text)
+}
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterWord
+	filterString
+	filterOp
+	filterLParen
+	filterRParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string // unquoted, for strings
+	pos  int
+}
+
+// Operators, longest first so <= is not read as <
+var filterOps = []string{"&&", "||", "!=", "<=", ">=", "=", "<", ">", "~", "!"}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	pos := 0
+	for {
+		for pos < len(expr) && unicode.IsSpace(rune(expr[pos])) {
+			pos++
+		}
+		if pos == len(expr) {
+			return append(tokens, filterToken{kind: filterEOF, pos: pos}), nil
+		}
+
+		switch c := expr[pos]; {
+		case c == '(':
+			tokens = append(tokens, filterToken{kind: filterLParen, text: "(", pos: pos})
+			pos++
+		case c == ')':
+			tokens = append(tokens, filterToken{kind: filterRParen, text: ")", pos: pos})
+			pos++
+		case c == '"':
+			end := pos + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, &FilterError{Position: pos, Message: "unterminated string"}
+			}
+			text, err := strconv.Unquote(expr[pos : end+1])
+			if err != nil {
+				return nil, &FilterError{Position: pos, Message: "invalid string " + expr[pos:end+1]}
+			}
+			tokens = append(tokens, filterToken{kind: filterString, text: text, pos: pos})
+			pos = end + 1
+		case strings.ContainsRune("&|!=<>~", rune(c)):
+			op := ""
+			for _, candidate := range filterOps {
+				if strings.HasPrefix(expr[pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &FilterError{Position: pos, Message: fmt.Sprintf("unexpected %q", c)}
+			}
+			tokens = append(tokens, filterToken{kind: filterOp, text: op, pos: pos})
+			pos += len(op)
+		default:
+			end := pos
+			for end < len(expr) && !unicode.IsSpace(rune(expr[end])) && !strings.ContainsRune("()\"&|!=<>~", rune(expr[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: filterWord, text: expr[pos:end], pos: pos})
+			pos = end
+		}
+	}
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != filterEOF {
+		p.pos++
+	}
+	return token
+}
+
+// isKeyword reports whether a token is AND, OR or NOT in any case, or the matching symbol
+func isKeyword(token filterToken, word string, symbol string) bool {
+	if token.kind == filterWord {
+		return strings.EqualFold(token.text, word)
+	}
+	return token.kind == filterOp && token.text == symbol
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "OR", "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "AND", "&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if isKeyword(p.peek(), "NOT", "!") {
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	token := p.next()
+	switch token.kind {
+	case filterLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != filterRParen {
+			return nil, &FilterError{Position: closing.pos, Message: "expected )"}
+		}
+		return node, nil
+	case filterWord, filterString:
+		if op := p.peek(); op.kind == filterOp && isComparison(op.text) {
+			return p.parseComparison(token)
+		}
+		if token.kind == filterWord && (isKeyword(token, "AND", "") || isKeyword(token, "OR", "")) {
+			break
+		}
+		re, err := regexp.Compile(token.text)
+		if err != nil {
+			return nil, &FilterError{Position: token.pos, Message: err.Error()}
+		}
+		return &keywordNode{re: re}, nil
+	case filterEOF:
+		return nil, &FilterError{Position: token.pos, Message: "expected a condition"}
+	}
+	return nil, &FilterError{Position: token.pos, Message: fmt.Sprintf("unexpected %q, expected a condition", token.text)}
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseComparison(fieldToken filterToken) (filterNode, error) {
+	if fieldToken.kind != filterWord {
+		return nil, &FilterError{Position: fieldToken.pos, Message: "expected a field before " + p.peek().text}
+	}
+	field, err := parseFilterField(fieldToken.text)
+	if err != nil {
+		return nil, &FilterError{Position: fieldToken.pos, Message: err.Error()}
+	}
+
+	op := p.next().text
+	valueToken := p.next()
+	if valueToken.kind != filterWord && valueToken.kind != filterString {
+		return nil, &FilterError{Position: valueToken.pos, Message: "expected a value after " + op}
+	}
+
+	node := &compareNode{field: field, op: op, literal: filterLiteral{text: valueToken.text}}
+	if op == "~" {
+		node.re, err = regexp.Compile(valueToken.text)
+		if err != nil {
+			return nil, &FilterError{Position: valueToken.pos, Message: err.Error()}
+		}
+		return node, nil
+	}
+
+	// Unquoted words are numbers, true, false or null if they can be, and strings otherwise
+	if valueToken.kind == filterWord {
+		switch valueToken.text {
+		case "true", "false":
+			node.literal.isBool, node.literal.bool = true, valueToken.text == "true"
+		case "null":
+			node.literal.isNull = true
+		default:
+			if _, err := strconv.ParseFloat(valueToken.text, 64); err == nil {
+				node.literal.number = valueToken.text
+			}
+		}
+	}
+	if (node.literal.isBool || node.literal.isNull) && op != "=" && op != "!=" {
+		return nil, &FilterError{Position: valueToken.pos, Message: fmt.Sprintf("%s can only be compared with = or !=", valueToken.text)}
+	}
+	if (field.source == "offset" || field.source == "partition") && node.literal.number == "" {
+		return nil, &FilterError{Position: valueToken.pos, Message: field.source + " must be compared with a number"}
+	}
+	return node, nil
+}
+
+// parseFilterField reads value, key, offset or partition, where value and key
+// may be followed by a path like .items[0].sku. A path alone is into the value.
+func parseFilterField(text string) (filterField, error) {
+	switch text {
+	case "offset", "partition", "value", "key":
+		return filterField{source: text}, nil
+	}
+
+	field := filterField{source: "value"}
+	rest := text
+	switch {
+	case strings.HasPrefix(text, "value."), strings.HasPrefix(text, "value["):
+		rest = text[len("value"):]
+	case strings.HasPrefix(text, "key."), strings.HasPrefix(text, "key["):
+		field.source, rest = "key", text[len("key"):]
+	case strings.HasPrefix(text, "."):
+	default:
+		return field, fmt.Errorf("unknown field %q, expected value, key, offset, partition or a path like value.id", text)
+	}
+
+	path, err := parseJSONPath(rest)
+	if err != nil {
+		return field, fmt.Errorf("invalid path %q: %s", text, err.Error())
+	}
+	field.path = path
+	return field, nil
+}
+
+// parseJSONPath reads steps like .name and [2]
+func parseJSONPath(path string) ([]interface{}, error) {
+	steps := []interface{}{}
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			end := 1
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("empty field name")
+			}
+			steps = append(steps, path[1:end])
+			path = path[end:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			index, err := strconv.Atoi(path[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q", path[1:end])
+			}
+			steps = append(steps, index)
+			path = path[end+1:]
+		default:
+			return nil, fmt.Errorf("expected . or [ at %q", path)
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/shopify/sarama"
+)
+
+// filterTree writes a parsed filter as a bracketed tree, to check how it grouped
+func filterTree(node filterNode) string {
+	switch n := node.(type) {
+	case *andNode:
+		return fmt.Sprintf("(and %s %s)", filterTree(n.left), filterTree(n.right))
+	case *orNode:
+		return fmt.Sprintf("(or %s %s)", filterTree(n.left), filterTree(n.right))
+	case *notNode:
+		return fmt.Sprintf("(not %s)", filterTree(n.node))
+	case *keywordNode:
+		return fmt.Sprintf("/%s/", n.re)
+	case *compareNode:
+		field := n.field.source
+		if n.field.path != nil {
+			field += fmt.Sprint(n.field.path)
+		}
+		return fmt.Sprintf("%s %s %q", field, n.op, n.literal.text)
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		tree string
+	}{
+		// Precedence: NOT binds tighter than AND, which binds tighter than OR
+		{`a OR b AND c`, `(or /a/ (and /b/ /c/))`},
+		{`a AND b OR c`, `(or (and /a/ /b/) /c/)`},
+		{`NOT a AND b`, `(and (not /a/) /b/)`},
+		{`NOT NOT a`, `(not (not /a/))`},
+		{`(a OR b) AND c`, `(and (or /a/ /b/) /c/)`},
+		{`a || b && !c`, `(or /a/ (and /b/ (not /c/)))`},
+		{`a or b and not c`, `(or /a/ (and /b/ (not /c/)))`},
+		{`a OR b OR c`, `(or (or /a/ /b/) /c/)`},
+
+		// Comparisons and fields
+		{`value.status = "PAID"`, `value[status] = "PAID"`},
+		{`.items[0].sku ~ "^AB"`, `value[items 0 sku] ~ "^AB"`},
+		{`key = "order-7"`, `key = "order-7"`},
+		{`offset >= 1000 AND offset < 2000`, `(and offset >= "1000" offset < "2000")`},
+		{`value.total>=100`, `value[total] >= "100"`},
+		{`partition != 3`, `partition != "3"`},
+
+		// Quoting
+		{`"two words"`, `/two words/`},
+		{`value.name = "a \"quoted\" name"`, `value[name] = "a \"quoted\" name"`},
+		{`value.op = "a AND b"`, `value[op] = "a AND b"`},
+		{`"a|b"`, `/a|b/`},
+
+		// Whole inputs that are only regular expressions
+		{`a|b`, `/a|b/`},
+		{`error|warn`, `/error|warn/`},
+		{`^(abc|def)$`, `/^(abc|def)$/`},
+		{`a=b`, `/a=b/`},
+		{`x<y>z`, `/x<y>z/`},
+		{`two words`, `/two words/`},
+		{`"unterminated`, `/"unterminated/`},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", test.expr, err)
+			continue
+		}
+		if tree := filterTree(filter.root); tree != test.tree {
+			t.Errorf("ParseFilter(%q) = %s, want %s", test.expr, tree, test.tree)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		position int
+	}{
+		// Neither a filter expression nor a regular expression
+		{`value.a = "x" AND (`, 19},
+		{`(a`, 2},
+		{`offset > "x(" AND [`, 9},
+		{``, 0},
+		{`   `, 3},
+	}
+	for _, test := range tests {
+		_, err := ParseFilter(test.expr)
+		filterErr, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("ParseFilter(%q) error = %v, want a *FilterError", test.expr, err)
+			continue
+		}
+		if filterErr.Position != test.position {
+			t.Errorf("ParseFilter(%q) error at %d (%s), want %d", test.expr, filterErr.Position, filterErr.Message, test.position)
+		}
+	}
+
+	// Trace filters are built as expressions, so they never fall back
+	if _, err := parseFilterExpression(`a|b`); err == nil {
+		t.Errorf("parseFilterExpression(%q) succeeded, want an error", `a|b`)
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	message := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte("order-7"),
+		Value:     []byte(`{"status": "PAID", "total": 120, "items": [{"sku": "AB-1"}], "note": "a|b"}`),
+	}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`value.status = "PAID" AND value.total >= 100`, true},
+		{`value.status = "PAID" AND value.total > 120`, false},
+		{`value.status = "NEW" OR value.total = 120`, true},
+		{`NOT value.status = "PAID" OR key = "order-7"`, true},
+		{`NOT (value.status = "PAID" OR key = "order-7")`, false},
+		{`.items[0].sku ~ "^AB"`, true},
+		{`.items[1].sku ~ "^AB"`, false},
+		{`offset = 42 AND partition = 2`, true},
+		{`PAID`, true},
+		{`UNPAID|SHIPPED`, false},
+		{`SHIPPED|PAID`, true},
+		{`"a|b"`, true},
+	}
+	decoders := NewDecoderRegistry()
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", test.expr, err)
+			continue
+		}
+		input := &filterInput{topic: message.Topic, message: message, decoders: decoders}
+		if match := filter.match(input); match != test.match {
+			t.Errorf("%q matched %v, want %v", test.expr, match, test.match)
+		}
+	}
+}
+
+func TestFilterOffsetRange(t *testing.T) {
+	tests := []struct {
+		expr       string
+		start, end int64
+	}{
+		{`offset >= 10 AND offset < 20`, 10, 20},
+		{`offset > 10 AND offset <= 20`, 11, 21},
+		{`offset = 5`, 5, 6},
+		{`offset >= 10 OR offset < 5`, 0, math.MaxInt64},
+		{`NOT offset < 5`, 0, math.MaxInt64},
+		{`value.offset > 5`, 0, math.MaxInt64},
+		{`offset = 9223372036854775807`, math.MaxInt64, math.MaxInt64},
+		{`offset > 9223372036854775807`, math.MaxInt64, math.MaxInt64},
+		{`offset <= 9223372036854775807`, 0, math.MaxInt64},
+	}
+	for _, test := range tests {
+		filter, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", test.expr, err)
+			continue
+		}
+		if start, end := filter.OffsetRange(); start != test.start || end != test.end {
+			t.Errorf("%q offsets %d-%d, want %d-%d", test.expr, start, end, test.start, test.end)
+		}
+	}
+}
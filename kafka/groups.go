@@ -0,0 +1,356 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// How many lag samples are kept per group, and how old they may get,
+// when working out whether a group is catching up
+const (
+	lagHistorySize   = 30
+	lagHistoryWindow = 10 * time.Minute
+)
+
+type GroupLag struct {
+	Group      string         `json:"group"`
+	TotalLag   int64          `json:"total_lag"`
+	Trend      string         `json:"trend"`              // growing, shrinking, steady or unknown
+	CatchUp    string         `json:"catch_up,omitempty"` // estimated time until lag reaches 0, if shrinking
+	LagPerSec  float64        `json:"lag_per_sec"`        // change in total lag per second over the history window
+	Partitions []PartitionLag `json:"partitions"`
+}
+
+type PartitionLag struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Committed int64  `json:"committed"`
+	LogEnd    int64  `json:"log_end"`
+	Lag       int64  `json:"lag"`
+}
+
+type lagSample struct {
+	at  time.Time
+	lag int64
+}
+
+// lagHistory holds recent lag samples by group and the topics the lag covered,
+// so totals over different topics are never compared
+type lagHistory struct {
+	lock    sync.Mutex
+	samples map[lagHistoryKey][]lagSample
+}
+
+type lagHistoryKey struct {
+	group  string
+	topics string // the sorted topics asked for, or empty for all
+}
+
+func newLagHistory() *lagHistory {
+	return &lagHistory{samples: make(map[lagHistoryKey][]lagSample)}
+}
+
+// record adds a lag sample for the group's topics and returns the samples still
+// inside the history window, oldest first. Histories with no sample inside the
+// window, from groups that were deleted or are no longer asked about, are dropped.
+func (h *lagHistory) record(group string, topics []string, sample lagSample) []lagSample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sorted := append([]string(nil), topics...)
+	sort.Strings(sorted)
+	key := lagHistoryKey{group: group, topics: strings.Join(sorted, ",")}
+
+	samples := append(h.samples[key], sample)
+	for len(samples) > 0 && sample.at.Sub(samples[0].at) > lagHistoryWindow {
+		samples = samples[1:]
+	}
+	if len(samples) > lagHistorySize {
+		samples = samples[len(samples)-lagHistorySize:]
+	}
+	h.samples[key] = samples
+
+	for other, otherSamples := range h.samples {
+		if sample.at.Sub(otherSamples[len(otherSamples)-1].at) > lagHistoryWindow {
+			delete(h.samples, other)
+		}
+	}
+
+	return append([]lagSample(nil), samples...)
+}
+
+// Coordinator returns the address of the broker that manages the group's offsets.
+func (kc KafkaConfig) Coordinator(group string) (string, error) {
+	var response *sarama.ConsumerMetadataResponse
+	err := kc.brokers.do(func(broker *sarama.Broker) (err error) {
+		response, err = broker.GetConsumerMetadata(&sarama.ConsumerMetadataRequest{ConsumerGroup: group})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.Err != sarama.ErrNoError {
+		return "", response.Err
+	}
+	return fmt.Sprintf("%s:%d", response.CoordinatorHost, response.CoordinatorPort), nil
+}
+
+// GroupOffsets returns the group's committed offset for every partition of topics.
+// All topics are checked if none are given. Partitions the group has never
+// committed to are left out.
+func (kc KafkaConfig) GroupOffsets(group string, topics []string) (map[string]map[int32]int64, error) {
+	if len(topics) == 0 {
+		var err error
+		topics, err = kc.client.Topics()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request := sarama.OffsetFetchRequest{ConsumerGroup: group}
+	for _, topic := range topics {
+		partitions, err := kc.client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+
+	coordinator, err := kc.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *sarama.OffsetFetchResponse
+	err = kc.brokers.doOn(coordinator, func(broker *sarama.Broker) (err error) {
+		response, err = broker.FetchOffset(&request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64)
+	for topic, partitions := range response.Blocks {
+		for partition, block := range partitions {
+			if block.Err == sarama.ErrUnknownTopicOrPartition || block.Offset < 0 {
+				continue
+			}
+			if block.Err != sarama.ErrNoError {
+				return nil, block.Err
+			}
+			if offsets[topic] == nil {
+				offsets[topic] = make(map[int32]int64)
+			}
+			offsets[topic][partition] = block.Offset
+		}
+	}
+	return offsets, nil
+}
+
+// GroupLag reports how far the group's committed offsets are behind the end of
+// each partition, and whether that lag is growing or shrinking since earlier calls.
+func (kc KafkaConfig) GroupLag(group string, topics []string) (*GroupLag, error) {
+	offsets, err := kc.GroupOffsets(group, topics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the log end of every committed partition in one request per leader
+	request := sarama.MetadataRequest{}
+	for topic := range offsets {
+		request.Topics = append(request.Topics, topic)
+	}
+	var logEnds map[topicPartition]*partitionOffsets
+	if len(request.Topics) > 0 {
+		metadata, err := kc.getMetadata(&request)
+		if err != nil {
+			return nil, err
+		}
+		logEnds = kc.leaderOffsets(metadata, sarama.LatestOffsets)
+	}
+
+	result := GroupLag{Group: group, Partitions: []PartitionLag{}}
+	for topic, partitions := range offsets {
+		for partition, committed := range partitions {
+			end, ok := logEnds[topicPartition{topic, partition}]
+			if !ok {
+				return nil, sarama.ErrUnknownTopicOrPartition
+			}
+			if end.err != nil {
+				return nil, end.err
+			}
+			logEnd := end.offsets[0]
+
+			lag := logEnd - committed
+			if lag < 0 {
+				lag = 0
+			}
+			result.TotalLag += lag
+			result.Partitions = append(result.Partitions, PartitionLag{
+				Topic:     topic,
+				Partition: partition,
+				Committed: committed,
+				LogEnd:    logEnd,
+				Lag:       lag,
+			})
+		}
+	}
+	sort.Sort(byTopicPartition(result.Partitions))
+
+	samples := kc.lagHistory.record(group, topics, lagSample{at: time.Now(), lag: result.TotalLag})
+	result.Trend, result.LagPerSec, result.CatchUp = lagTrend(samples)
+
+	return &result, nil
+}
+
+// lagTrend compares the oldest and newest samples to find the direction and
+// rate of change of lag, and how long until it reaches 0 at that rate
+func lagTrend(samples []lagSample) (string, float64, string) {
+	if len(samples) < 2 {
+		return "unknown", 0, ""
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return "unknown", 0, ""
+	}
+
+	rate := float64(last.lag-first.lag) / elapsed
+	switch {
+	case rate > 0:
+		return "growing", rate, ""
+	case rate < 0:
+		catchUp := time.Duration(float64(last.lag) / -rate * float64(time.Second))
+		catchUp -= catchUp % time.Second
+		return "shrinking", rate, catchUp.String()
+	default:
+		return "steady", rate, ""
+	}
+}
+
+type byTopicPartition []PartitionLag
+
+func (l byTopicPartition) Len() int      { return len(l) }
+func (l byTopicPartition) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byTopicPartition) Less(i, j int) bool {
+	if l[i].Topic != l[j].Topic {
+		return l[i].Topic < l[j].Topic
+	}
+	return l[i].Partition < l[j].Partition
+}
+
+// OffsetChange is the committed offset of a partition before and after a reset.
+// Before is -1 if the group had not committed an offset for the partition.
+type OffsetChange struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Before    int64  `json:"before"`
+	After     int64  `json:"after"`
+}
+
+// ResetGroupOffsets moves the group's committed offsets for the topic's partitions.
+// Each target is "earliest", "latest", an absolute offset such as "42", or a
+// shift from the committed offset such as "+10" or "-10". Targets are checked
+// against the offsets still held by the partition. When dryRun is set the
+// changes are worked out but not committed.
+func (kc KafkaConfig) ResetGroupOffsets(group string, topic string, targets map[int32]string, dryRun bool) ([]OffsetChange, error) {
+	committed, err := kc.GroupOffsets(group, []string{topic})
+	if err != nil {
+		return nil, err
+	}
+
+	request := sarama.OffsetCommitRequest{ConsumerGroup: group}
+	changes := make([]OffsetChange, 0, len(targets))
+	for partition, target := range targets {
+		before, ok := committed[topic][partition]
+		if !ok {
+			before = -1
+		}
+
+		earliest, latest, err := kc.OffsetBounds(topic, partition)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := resolveOffsetTarget(target, before, earliest, latest)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %s", partition, err.Error())
+		}
+
+		request.AddBlock(topic, partition, after, sarama.ReceiveTime, "kafka-viz")
+		changes = append(changes, OffsetChange{Topic: topic, Partition: partition, Before: before, After: after})
+	}
+	sort.Sort(byPartition(changes))
+
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	coordinator, err := kc.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *sarama.OffsetCommitResponse
+	err = kc.brokers.doOn(coordinator, func(broker *sarama.Broker) (err error) {
+		response, err = broker.CommitOffset(&request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for partition, kerr := range response.Errors[topic] {
+		if kerr != sarama.ErrNoError {
+			return nil, fmt.Errorf("partition %d: %s", partition, kerr.Error())
+		}
+	}
+
+	return changes, nil
+}
+
+// resolveOffsetTarget turns a reset target into an offset between earliest and latest
+func resolveOffsetTarget(target string, committed int64, earliest int64, latest int64) (int64, error) {
+	var offset int64
+	switch {
+	case target == "earliest":
+		return earliest, nil
+	case target == "latest":
+		return latest, nil
+	case strings.HasPrefix(target, "+") || strings.HasPrefix(target, "-"):
+		if committed < 0 {
+			return -1, fmt.Errorf("cannot shift by %s, the group has no committed offset", target)
+		}
+		shift, err := strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("invalid offset shift %q", target)
+		}
+		offset = committed + shift
+	default:
+		var err error
+		offset, err = strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("invalid offset target %q, expected earliest, latest, an offset or a +/- shift", target)
+		}
+	}
+
+	if offset < earliest || offset > latest {
+		return -1, fmt.Errorf("offset %d is outside the partition's range %d-%d", offset, earliest, latest)
+	}
+	return offset, nil
+}
+
+type byPartition []OffsetChange
+
+func (c byPartition) Len() int           { return len(c) }
+func (c byPartition) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byPartition) Less(i, j int) bool { return c[i].Partition < c[j].Partition }
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLagHistory(t *testing.T) {
+	history := newLagHistory()
+	start := time.Now()
+
+	history.record("g", nil, lagSample{at: start, lag: 100})
+	history.record("g", []string{"b", "a"}, lagSample{at: start, lag: 10})
+	samples := history.record("g", []string{"a", "b"}, lagSample{at: start.Add(time.Minute), lag: 5})
+	if len(samples) != 2 || samples[0].lag != 10 {
+		t.Errorf("filtered samples = %v, want the two for topics a and b", samples)
+	}
+	samples = history.record("g", nil, lagSample{at: start.Add(time.Minute), lag: 90})
+	if len(samples) != 2 || samples[0].lag != 100 {
+		t.Errorf("unfiltered samples = %v, want the two for all topics", samples)
+	}
+
+	// A group not asked about for the whole window is dropped
+	history.record("other", nil, lagSample{at: start.Add(lagHistoryWindow + 2*time.Minute), lag: 1})
+	if len(history.samples) != 1 {
+		t.Errorf("kept %d histories, want only the latest group's", len(history.samples))
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"sort"
+
+	"github.com/shopify/sarama"
+)
+
+// ClusterHealth lists the partitions that need attention and how
+// partition leadership is spread over the brokers.
+type ClusterHealth struct {
+	Healthy            bool                `json:"healthy"`
+	Offline            []PartitionHealth   `json:"offline"`              // no leader
+	UnderReplicated    []PartitionHealth   `json:"under_replicated"`     // ISR smaller than replica set
+	NotPreferredLeader []PartitionHealth   `json:"not_preferred_leader"` // leader is not the first replica
+	Brokers            []BrokerLeaderships `json:"brokers"`
+}
+
+type PartitionHealth struct {
+	Topic     string  `json:"topic"`
+	Partition int32   `json:"partition"`
+	Leader    int32   `json:"leader"`
+	Preferred int32   `json:"preferred"`
+	Replicas  []int32 `json:"replicas"`
+	Isr       []int32 `json:"isr"`
+}
+
+type BrokerLeaderships struct {
+	ID        int32  `json:"id"`
+	Addr      string `json:"addr"`
+	Leaders   int    `json:"leaders"`   // partitions this broker currently leads
+	Preferred int    `json:"preferred"` // partitions this broker should lead
+}
+
+func (kc KafkaConfig) ClusterHealth() (*ClusterHealth, error) {
+	response, err := kc.getMetadata(&sarama.MetadataRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	health := ClusterHealth{
+		Offline:            []PartitionHealth{},
+		UnderReplicated:    []PartitionHealth{},
+		NotPreferredLeader: []PartitionHealth{},
+	}
+
+	brokers := make(map[int32]*BrokerLeaderships)
+	for _, broker := range response.Brokers {
+		brokers[broker.ID()] = &BrokerLeaderships{ID: broker.ID(), Addr: broker.Addr()}
+	}
+	brokerFor := func(id int32) *BrokerLeaderships {
+		if brokers[id] == nil {
+			// Replica on a broker missing from the metadata, i.e. one that is down
+			brokers[id] = &BrokerLeaderships{ID: id}
+		}
+		return brokers[id]
+	}
+
+	for _, topic := range response.Topics {
+		for _, partition := range topic.Partitions {
+			status := PartitionHealth{
+				Topic:     topic.Name,
+				Partition: partition.ID,
+				Leader:    partition.Leader,
+				Preferred: -1,
+				Replicas:  partition.Replicas,
+				Isr:       partition.Isr,
+			}
+			if len(partition.Replicas) > 0 {
+				status.Preferred = partition.Replicas[0]
+				brokerFor(status.Preferred).Preferred++
+			}
+
+			if partition.Leader < 0 || partition.Err == sarama.ErrLeaderNotAvailable {
+				health.Offline = append(health.Offline, status)
+				continue
+			}
+			brokerFor(partition.Leader).Leaders++
+
+			if len(partition.Isr) < len(partition.Replicas) {
+				health.UnderReplicated = append(health.UnderReplicated, status)
+			}
+			if status.Preferred >= 0 && partition.Leader != status.Preferred {
+				health.NotPreferredLeader = append(health.NotPreferredLeader, status)
+			}
+		}
+	}
+
+	health.Brokers = make([]BrokerLeaderships, 0, len(brokers))
+	for _, broker := range brokers {
+		health.Brokers = append(health.Brokers, *broker)
+	}
+	sort.Sort(byBrokerID(health.Brokers))
+
+	health.Healthy = len(health.Offline) == 0 && len(health.UnderReplicated) == 0 && len(health.NotPreferredLeader) == 0
+	return &health, nil
+}
+
+type byBrokerID []BrokerLeaderships
+
+func (b byBrokerID) Len() int           { return len(b) }
+func (b byBrokerID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBrokerID) Less(i, j int) bool { return b[i].ID < b[j].ID }
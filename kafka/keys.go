@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// KeyPartitioner picks the partition a producer sends a key to.
+type KeyPartitioner func(key []byte, numPartitions int32) (int32, error)
+
+// keyPartitioners are the partitioners a key lookup can assume a topic's
+// producers used. none is for topics partitioned some other way, such as
+// round robin, where a key may be in any partition.
+var keyPartitioners = map[string]KeyPartitioner{
+	"hash":    hashPartition,
+	"murmur2": murmur2Partition,
+	"none":    nil,
+}
+
+// CheckKeyPartitioner reports whether a key lookup knows the partitioner:
+// hash (sarama's, the default), murmur2 (the Java client's) or none.
+func CheckKeyPartitioner(name string) error {
+	if _, ok := keyPartitioners[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unknown partitioner %q, expected hash, murmur2 or none", name)
+	}
+	return nil
+}
+
+// murmur2Partition picks the partition for a key the same way the Java
+// client's default partitioner does
+func murmur2Partition(key []byte, numPartitions int32) (int32, error) {
+	return (murmur2(key) & 0x7fffffff) % numPartitions, nil
+}
+
+// murmur2 is the 32 bit murmur2 hash with the seed the Java client uses
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// KeyLookupOptions choose where a key lookup searches.
+type KeyLookupOptions struct {
+	Partitioner string        // how the topic's producers partition keys, hash if empty
+	Partition   int32         // search only this partition, ignoring the partitioner, or -1
+	Newest      int64         // only search the newest messages of the partition, if set
+	MaxVersions int           // stop once this many versions are found, if set
+	Timeout     time.Duration // return what was found so far after this long, if set
+}
+
+func DefaultKeyLookupOptions() KeyLookupOptions {
+	return KeyLookupOptions{
+		Partitioner: "hash",
+		Partition:   -1,
+	}
+}
+
+// KeyLookup is every message with a key in the partitions it can be in.
+type KeyLookup struct {
+	Topic       string         `json:"topic"`
+	Key         string         `json:"key"`
+	Partitioner string         `json:"partitioner"`
+	Partitions  []int32        `json:"partitions"` // the partitions searched
+	Truncated   bool           `json:"truncated"`  // the search stopped at MaxVersions or the timeout
+	Versions    []MessageMatch `json:"versions"`   // oldest first within each partition
+	Topics      []TopicSummary `json:"topics"`
+}
+
+// keyNode matches messages whose raw key is exactly the given bytes
+type keyNode struct{ key []byte }
+
+func (n *keyNode) match(input *filterInput) bool {
+	return input.message.Key != nil && bytes.Equal(input.message.Key, n.key)
+}
+
+// LookupKey finds every message with the key. It searches only the partition
+// the partitioner sends the key to, or every partition if the partitioner is none.
+func (kc KafkaConfig) LookupKey(topic string, key []byte, options KeyLookupOptions) (*KeyLookup, error) {
+	if options.Partitioner == "" {
+		options.Partitioner = "hash"
+	}
+	options.Partitioner = strings.ToLower(options.Partitioner)
+	if err := CheckKeyPartitioner(options.Partitioner); err != nil {
+		return nil, err
+	}
+
+	numPartitions, err := kc.partitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []int32
+	partitioner := keyPartitioners[options.Partitioner]
+	switch {
+	case options.Partition >= 0:
+		if options.Partition >= numPartitions {
+			return nil, sarama.ErrUnknownTopicOrPartition
+		}
+		partitions = []int32{options.Partition}
+	case partitioner != nil:
+		partition, err := partitioner(key, numPartitions)
+		if err != nil {
+			return nil, err
+		}
+		partitions = []int32{partition}
+	default:
+		for partition := int32(0); partition < numPartitions; partition++ {
+			partitions = append(partitions, partition)
+		}
+	}
+
+	searchOptions := SearchOptions{
+		Filter: &Filter{
+			source: fmt.Sprintf("key = %s", strconv.Quote(string(key))),
+			root:   &keyNode{key: key},
+		},
+		Newest:     options.Newest,
+		MaxMatches: options.MaxVersions,
+		Partitions: partitions,
+		Progress:   NewSearchProgress(),
+	}
+	matches, truncated := kc.collectMatches([]string{topic}, searchOptions, options.Timeout)
+	sort.Sort(matchesByOffset(matches))
+	if matches == nil {
+		matches = []MessageMatch{}
+	}
+
+	return &KeyLookup{
+		Topic:       topic,
+		Key:         string(key),
+		Partitioner: options.Partitioner,
+		Partitions:  partitions,
+		Truncated:   truncated,
+		Versions:    matches,
+		Topics:      searchOptions.Progress.Topics(),
+	}, nil
+}
+
+// matchesByOffset sorts matches by partition, then offset
+type matchesByOffset []MessageMatch
+
+func (m matchesByOffset) Len() int      { return len(m) }
+func (m matchesByOffset) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matchesByOffset) Less(i, j int) bool {
+	if m[i].Partition != m[j].Partition {
+		return m[i].Partition < m[j].Partition
+	}
+	return m[i].Offset < m[j].Offset
+}
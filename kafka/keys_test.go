@@ -0,0 +1,39 @@
+package client
+
+import "testing"
+
+// Vectors from Kafka's UtilsTest.testMurmur2, which the Java client's
+// default partitioner hashes keys with
+var murmur2Tests = []struct {
+	key       string
+	hash      int32
+	partition int32 // of 12
+}{
+	{"21", -973932308, 0},
+	{"foobar", -790332482, 6},
+	{"a-little-bit-long-string", -985981536, 8},
+	{"a-little-bit-longer-string", -1486304829, 11},
+	{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971, 5},
+	{"abc", 479470107, 3},
+}
+
+func TestMurmur2(t *testing.T) {
+	for _, test := range murmur2Tests {
+		if hash := murmur2([]byte(test.key)); hash != test.hash {
+			t.Errorf("murmur2(%q) = %d, want %d", test.key, hash, test.hash)
+		}
+	}
+}
+
+func TestMurmur2Partition(t *testing.T) {
+	for _, test := range murmur2Tests {
+		partition, err := murmur2Partition([]byte(test.key), 12)
+		if err != nil {
+			t.Errorf("murmur2Partition(%q): %s", test.key, err)
+			continue
+		}
+		if partition != test.partition {
+			t.Errorf("murmur2Partition(%q, 12) = %d, want %d", test.key, partition, test.partition)
+		}
+	}
+}
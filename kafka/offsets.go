@@ -0,0 +1,137 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/shopify/sarama"
+)
+
+// topicPartition names a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets are a partition's offsets at each of the times asked for,
+// or why they couldn't be read
+type partitionOffsets struct {
+	offsets []int64
+	err     error
+}
+
+// leaderOffsets reads the offsets at each time of every partition in the
+// metadata response. Each leader gets a single OffsetRequest per time covering
+// all of its partitions, and the leaders are asked in parallel, so the cost
+// doesn't grow with the number of partitions. Partitions without a leader, or
+// whose leader fails, get an error instead.
+func (kc KafkaConfig) leaderOffsets(metadata *sarama.MetadataResponse, times ...sarama.OffsetTime) map[topicPartition]*partitionOffsets {
+	addrs := make(map[int32]string)
+	for _, broker := range metadata.Brokers {
+		addrs[broker.ID()] = broker.Addr()
+	}
+
+	result := make(map[topicPartition]*partitionOffsets)
+	byLeader := make(map[int32][]topicPartition)
+	for _, topic := range metadata.Topics {
+		for _, partition := range topic.Partitions {
+			tp := topicPartition{topic.Name, partition.ID}
+			result[tp] = &partitionOffsets{offsets: make([]int64, len(times))}
+			switch {
+			case partition.Leader < 0:
+				result[tp].err = sarama.ErrLeaderNotAvailable
+			case addrs[partition.Leader] == "":
+				result[tp].err = fmt.Errorf("leader %d is not in the metadata", partition.Leader)
+			default:
+				byLeader[partition.Leader] = append(byLeader[partition.Leader], tp)
+			}
+		}
+	}
+
+	// Each goroutine only writes the entries of its own leader's partitions
+	var wg sync.WaitGroup
+	for leader, partitions := range byLeader {
+		wg.Add(1)
+		go func(addr string, partitions []topicPartition) {
+			defer wg.Done()
+			for i, at := range times {
+				kc.brokerOffsets(addr, partitions, at, i, result)
+			}
+		}(addrs[leader], partitions)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// brokerOffsets asks one broker for the offsets at a time of its partitions,
+// storing them as the i'th offset of each
+func (kc KafkaConfig) brokerOffsets(addr string, partitions []topicPartition, at sarama.OffsetTime, i int, result map[topicPartition]*partitionOffsets) {
+	request := &sarama.OffsetRequest{}
+	for _, tp := range partitions {
+		request.AddBlock(tp.topic, tp.partition, at, 1)
+	}
+
+	var response *sarama.OffsetResponse
+	err := kc.brokers.doOn(addr, func(broker *sarama.Broker) (err error) {
+		response, err = broker.GetAvailableOffsets(request)
+		return err
+	})
+
+	for _, tp := range partitions {
+		offsets := result[tp]
+		if offsets.err != nil {
+			continue
+		}
+		if err != nil {
+			offsets.err = err
+			continue
+		}
+
+		block := response.GetBlock(tp.topic, tp.partition)
+		switch {
+		case block != nil && block.Err != sarama.ErrNoError:
+			offsets.err = block.Err
+		case block == nil:
+			offsets.err = sarama.ErrIncompleteResponse
+		case len(block.Offsets) != 1:
+			// As from sarama's GetOffset: there is no offset for the time
+			offsets.err = sarama.ErrOffsetOutOfRange
+		default:
+			offsets.offsets[i] = block.Offsets[0]
+		}
+	}
+}
+
+// offsetsAt reads one partition's offsets at each time from its leader,
+// looking the leader up again once if it fails, as it may have moved
+func (kc KafkaConfig) offsetsAt(topic string, partition int32, times ...sarama.OffsetTime) ([]int64, error) {
+	tp := topicPartition{topic, partition}
+	var offsets *partitionOffsets
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			err := kc.refreshMetadata(topic)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		addr, err := kc.leader(topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		offsets = &partitionOffsets{offsets: make([]int64, len(times))}
+		result := map[topicPartition]*partitionOffsets{tp: offsets}
+		for i, at := range times {
+			kc.brokerOffsets(addr, []topicPartition{tp}, at, i, result)
+		}
+		// No offset for a time isn't the leader's fault
+		if offsets.err == nil || offsets.err == sarama.ErrOffsetOutOfRange {
+			break
+		}
+	}
+	if offsets.err != nil {
+		return nil, offsets.err
+	}
+	return offsets.offsets, nil
+}
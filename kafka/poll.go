@@ -0,0 +1,97 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// PollHub runs a single metadata poller per topic and fans its updates out
+// to every subscriber of that topic. A topic's poller is started by its first
+// subscriber and stopped when its last subscriber leaves.
+type PollHub struct {
+	kafka    *KafkaConfig
+	interval time.Duration
+
+	lock    sync.Mutex
+	pollers map[string]*topicPoller
+}
+
+type topicPoller struct {
+	subscribers map[chan string]struct{}
+	stop        chan struct{}
+}
+
+func NewPollHub(kafka *KafkaConfig, interval time.Duration) *PollHub {
+	return &PollHub{
+		kafka:    kafka,
+		interval: interval,
+		pollers:  make(map[string]*topicPoller),
+	}
+}
+
+// Subscribe returns a channel that receives the topic's metadata on every poll.
+// A subscriber that falls behind has its unread update replaced by the newest
+// one, so it never blocks the poller and never reads stale metadata.
+func (h *PollHub) Subscribe(topic string) chan string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	poller, ok := h.pollers[topic]
+	if !ok {
+		poller = &topicPoller{
+			subscribers: make(map[chan string]struct{}),
+			stop:        make(chan struct{}),
+		}
+		h.pollers[topic] = poller
+		go h.run(topic, poller)
+	}
+
+	sub := make(chan string, 1)
+	poller.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe removes sub from the topic's subscribers, stopping the topic's
+// poller if sub was the last one.
+func (h *PollHub) Unsubscribe(topic string, sub chan string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	poller, ok := h.pollers[topic]
+	if !ok {
+		return
+	}
+
+	delete(poller.subscribers, sub)
+	if len(poller.subscribers) == 0 {
+		close(poller.stop)
+		delete(h.pollers, topic)
+	}
+}
+
+func (h *PollHub) run(topic string, poller *topicPoller) {
+	updates := make(chan string)
+	go h.kafka.Poll(topic, h.interval, updates, poller.stop)
+
+	for {
+		select {
+		case update := <-updates:
+			h.broadcast(poller, update)
+		case <-poller.stop:
+			return
+		}
+	}
+}
+
+func (h *PollHub) broadcast(poller *topicPoller, update string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for sub := range poller.subscribers {
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- update
+	}
+}
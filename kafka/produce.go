@@ -0,0 +1,268 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// ProduceOptions control how a single message is produced.
+type ProduceOptions struct {
+	Key          []byte // nil to send the message without a key
+	Partition    int32  // -1 to choose the partition from the key, as sarama's hash partitioner does
+	RequiredAcks sarama.RequiredAcks
+	Compression  sarama.CompressionCodec
+}
+
+func DefaultProduceOptions() ProduceOptions {
+	return ProduceOptions{
+		Partition:    -1,
+		RequiredAcks: sarama.WaitForLocal,
+		Compression:  sarama.CompressionNone,
+	}
+}
+
+// ParseRequiredAcks reads an acks level: none (0), local (1) or all (-1).
+func ParseRequiredAcks(acks string) (sarama.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "none", "0":
+		return sarama.NoResponse, nil
+	case "", "local", "1":
+		return sarama.WaitForLocal, nil
+	case "all", "-1":
+		return sarama.WaitForAll, nil
+	}
+	return sarama.WaitForLocal, fmt.Errorf("invalid acks %q, expected none, local or all", acks)
+}
+
+// ParseCompression reads a compression codec: none, gzip or snappy.
+func ParseCompression(codec string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(codec) {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	}
+	return sarama.CompressionNone, fmt.Errorf("invalid compression %q, expected none, gzip or snappy", codec)
+}
+
+// How long Produce waits for the broker to acknowledge a message
+const produceTimeout = 30 * time.Second
+
+// Produced is where the broker stored a message. Offset is -1 when
+// the message was sent without waiting for acks.
+type Produced struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Produce sends the message to the topic and waits for the broker to store it.
+func (kc KafkaConfig) Produce(message string, topic string, options ProduceOptions) (*Produced, error) {
+	numPartitions, err := kc.partitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := kc.send(sarama.StringEncoder(message), topic, numPartitions, options)
+	if err != nil {
+		return nil, err
+	}
+	return pending.wait()
+}
+
+func (kc KafkaConfig) partitionCount(topic string) (int32, error) {
+	partitions, err := kc.client.Partitions(topic)
+	if err != nil {
+		return -1, err
+	}
+	if len(partitions) == 0 {
+		return -1, sarama.ErrLeaderNotAvailable
+	}
+	return int32(len(partitions)), nil
+}
+
+// pendingMessage is a message handed to a producer that the broker has not acknowledged yet
+type pendingMessage struct {
+	msg      *sarama.ProducerMessage
+	request  *produceRequest
+	acks     sarama.RequiredAcks
+	deadline <-chan time.Time
+}
+
+// send queues the message on the producer for its options without waiting for the broker
+func (kc KafkaConfig) send(value sarama.Encoder, topic string, numPartitions int32, options ProduceOptions) (*pendingMessage, error) {
+	var err error
+	partition := options.Partition
+	if partition < 0 {
+		partition, err = hashPartition(options.Key, numPartitions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if partition >= numPartitions {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+
+	producer, err := kc.producers.get(options.RequiredAcks, options.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &pendingMessage{
+		request:  &produceRequest{partition: partition, result: make(chan error, 1)},
+		acks:     options.RequiredAcks,
+		deadline: time.After(produceTimeout),
+	}
+	pending.msg = &sarama.ProducerMessage{
+		Topic:    topic,
+		Value:    value,
+		Metadata: pending.request,
+	}
+	if options.Key != nil {
+		pending.msg.Key = sarama.ByteEncoder(options.Key)
+	}
+
+	select {
+	case producer.Input() <- pending.msg:
+	case <-pending.deadline:
+		return nil, fmt.Errorf("timed out sending message to topic %s", topic)
+	}
+	return pending, nil
+}
+
+// wait blocks until the broker has stored the message or failed to
+func (pending *pendingMessage) wait() (*Produced, error) {
+	select {
+	case err := <-pending.request.result:
+		if err != nil {
+			return nil, err
+		}
+	case <-pending.deadline:
+		return nil, fmt.Errorf("timed out waiting for topic %s to acknowledge message", pending.msg.Topic)
+	}
+
+	produced := Produced{
+		Topic:     pending.msg.Topic,
+		Partition: pending.msg.Partition(),
+		Offset:    pending.msg.Offset(),
+	}
+	if pending.acks == sarama.NoResponse {
+		produced.Offset = -1
+	}
+	return &produced, nil
+}
+
+// KafkaErrorCode returns the Kafka protocol error code behind err, if it has one.
+func KafkaErrorCode(err error) (int16, bool) {
+	kerr, ok := err.(sarama.KError)
+	return int16(kerr), ok
+}
+
+// hashPartition picks the partition for a key the same way sarama's hash partitioner does
+func hashPartition(key []byte, numPartitions int32) (int32, error) {
+	msg := &sarama.ProducerMessage{}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	return sarama.NewHashPartitioner().Partition(msg, numPartitions)
+}
+
+// produceRequest travels with a message through the producer in its Metadata field,
+// carrying the chosen partition in and the delivery result out
+type produceRequest struct {
+	partition int32
+	result    chan error
+}
+
+// explicitPartitioner sends each message to the partition already chosen by Produce
+type explicitPartitioner struct{}
+
+func newExplicitPartitioner() sarama.Partitioner {
+	return explicitPartitioner{}
+}
+
+func (explicitPartitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	request, ok := message.Metadata.(*produceRequest)
+	if !ok {
+		return -1, sarama.ErrInvalidPartition
+	}
+	return request.partition, nil
+}
+
+func (explicitPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+// producerSet lazily creates one producer for each acks level and compression codec,
+// since sarama fixes both for the lifetime of a producer
+type producerSet struct {
+	addrs []string
+
+	lock      sync.Mutex
+	producers map[producerKey]sarama.Producer
+}
+
+type producerKey struct {
+	acks        sarama.RequiredAcks
+	compression sarama.CompressionCodec
+}
+
+func newProducerSet(addrs []string) *producerSet {
+	return &producerSet{
+		addrs:     addrs,
+		producers: make(map[producerKey]sarama.Producer),
+	}
+}
+
+func (ps *producerSet) get(acks sarama.RequiredAcks, compression sarama.CompressionCodec) (sarama.Producer, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	key := producerKey{acks: acks, compression: compression}
+	if producer, ok := ps.producers[key]; ok {
+		return producer, nil
+	}
+
+	conf := sarama.NewConfig()
+	conf.Producer.RequiredAcks = acks
+	conf.Producer.Compression = compression
+	conf.Producer.Partitioner = newExplicitPartitioner
+	conf.Producer.AckSuccesses = true
+
+	producer, err := sarama.NewProducer(ps.addrs, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hand each delivery result back to the Produce call waiting for it.
+	// The producer deadlocks unless both channels are read.
+	go func() {
+		for msg := range producer.Successes() {
+			msg.Metadata.(*produceRequest).result <- nil
+		}
+	}()
+	go func() {
+		for err := range producer.Errors() {
+			err.Msg.Metadata.(*produceRequest).result <- err.Err
+		}
+	}()
+
+	ps.producers[key] = producer
+	return producer, nil
+}
+
+func (ps *producerSet) close() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for key, producer := range ps.producers {
+		producer.Close()
+		delete(ps.producers, key)
+	}
+}
@@ -0,0 +1,626 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// How deeply protobuf messages may nest, so corrupt data can't exhaust the stack
+const protoMaxDepth = 100
+
+// Protobuf wire types
+const (
+	protoVarint     = 0
+	protoFixed64    = 1
+	protoBytes      = 2
+	protoStartGroup = 3
+	protoEndGroup   = 4
+	protoFixed32    = 5
+)
+
+// Field types from descriptor.proto's FieldDescriptorProto.Type
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+// protobufDecoder decodes protobuf messages to JSON with the message types in a
+// compiled descriptor set, following the proto3 JSON mapping: 64 bit integers
+// are strings, bytes are base64 and enums are their value names. Fields not in
+// the descriptor are kept under "_unknown" with their field number and wire type.
+type protobufDecoder struct {
+	messages map[string]*protoMessage // by full name, without the leading dot
+	enums    map[string]map[int32]string
+	topics   map[string]string // topic to the message type of its values
+	keys     map[string]string // topic to the message type of its keys
+}
+
+type protoMessage struct {
+	name     string
+	fields   []*protoField
+	byNumber map[int32]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	jsonName string
+	number   int32
+	repeated bool
+	typ      int32
+	typeName string
+}
+
+// NewProtobufDecoder reads a FileDescriptorSet, as written by
+// protoc --include_imports --descriptor_set_out, and returns a decoder for
+// topics whose values and keys are the given message types, e.g. "shop.Order".
+func NewProtobufDecoder(descriptorSetFile string, topicTypes map[string]string, keyTypes map[string]string) (Decoder, error) {
+	descriptorSet, err := ioutil.ReadFile(descriptorSetFile)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &protobufDecoder{
+		messages: make(map[string]*protoMessage),
+		enums:    make(map[string]map[int32]string),
+		topics:   topicTypes,
+		keys:     keyTypes,
+	}
+	err = d.parseDescriptorSet(descriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("reading descriptor set %s: %s", descriptorSetFile, err.Error())
+	}
+
+	for _, types := range []map[string]string{topicTypes, keyTypes} {
+		for topic, name := range types {
+			if _, ok := d.messages[strings.TrimPrefix(name, ".")]; !ok {
+				return nil, fmt.Errorf("message type %s for topic %s is not in descriptor set %s", name, topic, descriptorSetFile)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (*protobufDecoder) Name() string { return "protobuf" }
+
+func (d *protobufDecoder) Decode(topic string, key bool, data []byte) (string, error) {
+	name, ok := d.topics[topic]
+	if key {
+		name, ok = d.keys[topic]
+	}
+	if !ok {
+		return "", fmt.Errorf("no protobuf message type is set for topic %s", topic)
+	}
+
+	value, err := d.decodeMessage(d.messages[strings.TrimPrefix(name, ".")], data, 0)
+	if err != nil {
+		return "", err
+	}
+
+	pretty, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(pretty), nil
+}
+
+func (d *protobufDecoder) parseDescriptorSet(data []byte) error {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return err
+	}
+	for _, file := range fields {
+		if file.number != 1 || file.wireType != protoBytes {
+			continue
+		}
+		err = d.parseFile(file.data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFile reads a FileDescriptorProto
+func (d *protobufDecoder) parseFile(data []byte) error {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	var pkg string
+	for _, field := range fields {
+		if field.number == 2 && field.wireType == protoBytes {
+			pkg = string(field.data)
+		}
+	}
+
+	for _, field := range fields {
+		if field.wireType != protoBytes {
+			continue
+		}
+		switch field.number {
+		case 4:
+			err = d.parseMessage(field.data, pkg)
+		case 5:
+			err = d.parseEnum(field.data, pkg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMessage reads a DescriptorProto and the types nested in it
+func (d *protobufDecoder) parseMessage(data []byte, scope string) error {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	message := &protoMessage{byNumber: make(map[int32]*protoField)}
+	for _, field := range fields {
+		if field.number == 1 && field.wireType == protoBytes {
+			message.name = protoFullName(scope, string(field.data))
+		}
+	}
+
+	for _, field := range fields {
+		if field.wireType != protoBytes {
+			continue
+		}
+		switch field.number {
+		case 2:
+			var messageField *protoField
+			messageField, err = parseProtoField(field.data)
+			if err == nil {
+				message.fields = append(message.fields, messageField)
+				message.byNumber[messageField.number] = messageField
+			}
+		case 3:
+			err = d.parseMessage(field.data, message.name)
+		case 4:
+			err = d.parseEnum(field.data, message.name)
+		case 7:
+			// MessageOptions.map_entry marks the generated entry type of a map field
+			var options []protoRawField
+			options, err = readProtoFields(field.data)
+			for _, option := range options {
+				if option.number == 7 && option.wireType == protoVarint {
+					message.mapEntry = option.value != 0
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	d.messages[message.name] = message
+	return nil
+}
+
+// parseProtoField reads a FieldDescriptorProto
+func parseProtoField(data []byte) (*protoField, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	field := &protoField{}
+	for _, raw := range fields {
+		switch raw.number {
+		case 1:
+			field.name = string(raw.data)
+		case 3:
+			field.number = int32(raw.value)
+		case 4:
+			field.repeated = raw.value == 3 // LABEL_REPEATED
+		case 5:
+			field.typ = int32(raw.value)
+		case 6:
+			field.typeName = strings.TrimPrefix(string(raw.data), ".")
+		case 10:
+			field.jsonName = string(raw.data)
+		}
+	}
+	if field.jsonName == "" {
+		field.jsonName = field.name
+	}
+	return field, nil
+}
+
+// parseEnum reads an EnumDescriptorProto
+func (d *protobufDecoder) parseEnum(data []byte, scope string) error {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	values := make(map[int32]string)
+	for _, field := range fields {
+		switch {
+		case field.number == 1 && field.wireType == protoBytes:
+			name = protoFullName(scope, string(field.data))
+		case field.number == 2 && field.wireType == protoBytes:
+			valueFields, err := readProtoFields(field.data)
+			if err != nil {
+				return err
+			}
+			var valueName string
+			var number int32
+			for _, valueField := range valueFields {
+				switch valueField.number {
+				case 1:
+					valueName = string(valueField.data)
+				case 2:
+					number = int32(valueField.value)
+				}
+			}
+			// The first name wins when values are aliased
+			if _, ok := values[number]; !ok {
+				values[number] = valueName
+			}
+		}
+	}
+
+	d.enums[name] = values
+	return nil
+}
+
+func protoFullName(scope string, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// decodeMessage returns a message's fields in descriptor order, then any unknown fields
+func (d *protobufDecoder) decodeMessage(message *protoMessage, data []byte, depth int) (jsonObject, error) {
+	if depth > protoMaxDepth {
+		return nil, fmt.Errorf("messages nested more than %d deep", protoMaxDepth)
+	}
+
+	raw, err := readProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[int32]interface{})
+	unknown := []interface{}{}
+	for _, field := range raw {
+		descriptor, ok := message.byNumber[field.number]
+		if !ok {
+			unknown = append(unknown, protoUnknownField(field))
+			continue
+		}
+
+		items, err := d.decodeField(descriptor, field, depth)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", message.name, descriptor.name, err.Error())
+		}
+
+		switch {
+		case d.isMap(descriptor):
+			entries, _ := values[descriptor.number].(jsonObject)
+			for _, item := range items {
+				entries = setMapEntry(entries, item.(jsonObject))
+			}
+			values[descriptor.number] = entries
+		case descriptor.repeated:
+			list, _ := values[descriptor.number].([]interface{})
+			values[descriptor.number] = append(list, items...)
+		default:
+			values[descriptor.number] = items[len(items)-1]
+		}
+	}
+
+	object := jsonObject{}
+	for _, descriptor := range message.fields {
+		if value, ok := values[descriptor.number]; ok {
+			object = append(object, jsonField{name: descriptor.jsonName, value: value})
+		}
+	}
+	if len(unknown) > 0 {
+		object = append(object, jsonField{name: "_unknown", value: unknown})
+	}
+	return object, nil
+}
+
+func (d *protobufDecoder) isMap(field *protoField) bool {
+	if field.typ != protoTypeMessage || !field.repeated {
+		return false
+	}
+	message, ok := d.messages[field.typeName]
+	return ok && message.mapEntry
+}
+
+// setMapEntry adds a decoded map entry message to a map field, keyed by the entry's key
+func setMapEntry(entries jsonObject, entry jsonObject) jsonObject {
+	var key string
+	var value interface{}
+	for _, field := range entry {
+		switch field.name {
+		case "key":
+			key = fmt.Sprint(field.value)
+		case "value":
+			value = field.value
+		}
+	}
+
+	for i := range entries {
+		if entries[i].name == key {
+			entries[i].value = value
+			return entries
+		}
+	}
+	return append(entries, jsonField{name: key, value: value})
+}
+
+// decodeField returns the values in one occurrence of a field,
+// which is several for a packed repeated field
+func (d *protobufDecoder) decodeField(descriptor *protoField, field protoRawField, depth int) ([]interface{}, error) {
+	switch descriptor.typ {
+	case protoTypeString:
+		if field.wireType != protoBytes {
+			break
+		}
+		return []interface{}{string(field.data)}, nil
+	case protoTypeBytes:
+		if field.wireType != protoBytes {
+			break
+		}
+		return []interface{}{base64.StdEncoding.EncodeToString(field.data)}, nil
+	case protoTypeMessage, protoTypeGroup:
+		if field.wireType != protoBytes && field.wireType != protoStartGroup {
+			break
+		}
+		message, ok := d.messages[descriptor.typeName]
+		if !ok {
+			return nil, fmt.Errorf("message type %s is not in the descriptor set", descriptor.typeName)
+		}
+		value, err := d.decodeMessage(message, field.data, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	default:
+		wireType := protoScalarWireType(descriptor.typ)
+		if field.wireType == wireType {
+			return []interface{}{d.scalar(descriptor, field.value)}, nil
+		}
+		if field.wireType == protoBytes && descriptor.repeated {
+			return d.decodePacked(descriptor, wireType, field.data)
+		}
+	}
+	return nil, fmt.Errorf("unexpected wire type %d", field.wireType)
+}
+
+func (d *protobufDecoder) decodePacked(descriptor *protoField, wireType int, data []byte) ([]interface{}, error) {
+	reader := &protoReader{data: data}
+	items := []interface{}{}
+	for !reader.done() {
+		value, err := reader.scalar(wireType)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, d.scalar(descriptor, value))
+	}
+	return items, nil
+}
+
+// protoScalarWireType is the wire type of an unpacked scalar field
+func protoScalarWireType(typ int32) int {
+	switch typ {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoFixed32
+	}
+	return protoVarint
+}
+
+// scalar converts the raw bits of a numeric, bool or enum field to its JSON form
+func (d *protobufDecoder) scalar(descriptor *protoField, value uint64) interface{} {
+	switch descriptor.typ {
+	case protoTypeDouble:
+		return protoFloat(math.Float64frombits(value))
+	case protoTypeFloat:
+		return protoFloat(float64(math.Float32frombits(uint32(value))))
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(value), 10)
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(value, 10)
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10)
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(value)
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(value)
+	case protoTypeSint32:
+		return int32(uint32(value)>>1) ^ -int32(value&1)
+	case protoTypeBool:
+		return value != 0
+	case protoTypeEnum:
+		if name, ok := d.enums[descriptor.typeName][int32(value)]; ok {
+			return name
+		}
+		return int32(value)
+	}
+	return value
+}
+
+// protoFloat returns NaN and infinities as the strings the proto3 JSON mapping uses
+func protoFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+// protoUnknownField shows a field that is not in the descriptor: numbers as
+// decimal strings and length delimited data and groups as base64
+func protoUnknownField(field protoRawField) jsonObject {
+	var value interface{}
+	switch field.wireType {
+	case protoBytes, protoStartGroup:
+		value = base64.StdEncoding.EncodeToString(field.data)
+	default:
+		value = strconv.FormatUint(field.value, 10)
+	}
+	return jsonObject{
+		{name: "field", value: field.number},
+		{name: "wire_type", value: field.wireType},
+		{name: "value", value: value},
+	}
+}
+
+// protoRawField is a field read from the wire. Numbers are in value, and the
+// contents of length delimited fields and groups are in data.
+type protoRawField struct {
+	number   int32
+	wireType int
+	value    uint64
+	data     []byte
+}
+
+func readProtoFields(data []byte) ([]protoRawField, error) {
+	reader := &protoReader{data: data}
+	var fields []protoRawField
+	for !reader.done() {
+		field, err := reader.field()
+		if err != nil {
+			return nil, err
+		}
+		if field.wireType == protoEndGroup {
+			return nil, fmt.Errorf("unexpected end of group %d", field.number)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+type protoReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *protoReader) field() (protoRawField, error) {
+	tag, err := r.varint()
+	if err != nil {
+		return protoRawField{}, err
+	}
+	field := protoRawField{number: int32(tag >> 3), wireType: int(tag & 7)}
+	if field.number <= 0 {
+		return field, fmt.Errorf("invalid field number %d", field.number)
+	}
+
+	switch field.wireType {
+	case protoBytes:
+		length, err := r.varint()
+		if err != nil {
+			return field, err
+		}
+		if length > uint64(len(r.data)-r.pos) {
+			return field, fmt.Errorf("field %d is longer than the message", field.number)
+		}
+		field.data = r.data[r.pos : r.pos+int(length)]
+		r.pos += int(length)
+	case protoStartGroup:
+		field.data, err = r.group(field.number)
+	case protoEndGroup:
+	default:
+		field.value, err = r.scalar(field.wireType)
+	}
+	return field, err
+}
+
+// group returns the contents of a group, up to its matching end group tag
+func (r *protoReader) group(number int32) ([]byte, error) {
+	start := r.pos
+	for !r.done() {
+		end := r.pos
+		field, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if field.wireType == protoEndGroup {
+			if field.number != number {
+				return nil, fmt.Errorf("group %d ended by end of group %d", number, field.number)
+			}
+			return r.data[start:end], nil
+		}
+	}
+	return nil, fmt.Errorf("group %d is not ended", number)
+}
+
+func (r *protoReader) scalar(wireType int) (uint64, error) {
+	switch wireType {
+	case protoVarint:
+		return r.varint()
+	case protoFixed64:
+		if len(r.data)-r.pos < 8 {
+			return 0, fmt.Errorf("message ends inside a fixed64 field")
+		}
+		value := binary.LittleEndian.Uint64(r.data[r.pos:])
+		r.pos += 8
+		return value, nil
+	case protoFixed32:
+		if len(r.data)-r.pos < 4 {
+			return 0, fmt.Errorf("message ends inside a fixed32 field")
+		}
+		value := binary.LittleEndian.Uint32(r.data[r.pos:])
+		r.pos += 4
+		return uint64(value), nil
+	}
+	return 0, fmt.Errorf("invalid wire type %d", wireType)
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if r.done() {
+			return 0, fmt.Errorf("message ends inside a varint")
+		}
+		b := r.data[r.pos]
+		r.pos++
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("varint is too long")
+}
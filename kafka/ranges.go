@@ -0,0 +1,228 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// OffsetRange is a range of a partition's offsets, written as one of
+//
+//	42            one offset
+//	100-199       offsets 100 to 199
+//	100-          offsets from 100 to the end of the log
+//	-50           the last 50 messages
+//	earliest      the oldest message; earliest and latest also work in ranges,
+//	latest        like earliest-200 or 100-latest
+//	@<time>       messages from about a time to the end of the log, where the
+//	              time is RFC 3339 or seconds or milliseconds since the epoch
+//
+// Open ranges are cut to a limit of messages when resolved, and other ranges
+// may not cover more than it.
+type OffsetRange struct {
+	text  string
+	start offsetBound
+	end   *offsetBound // nil if the range runs to the end of the log
+	last  int64        // the range is the last this many messages, if set
+	at    *time.Time   // the range starts from this time, if set
+}
+
+// offsetBound is an offset, or earliest or latest
+type offsetBound struct {
+	keyword string
+	offset  int64
+}
+
+// OffsetRangeError says what is wrong with an offset range: its Code is
+// invalid, reversed, empty (the partition holds no messages), out_of_range or
+// too_large (more messages than the limit).
+// Earliest and Latest are the partition's offsets, once they are known.
+type OffsetRangeError struct {
+	Range    string `json:"range"`
+	Code     string `json:"code"`
+	Message  string `json:"error"`
+	Earliest *int64 `json:"earliest,omitempty"`
+	Latest   *int64 `json:"latest,omitempty"` // the offset the next message will get
+}
+
+func (e *OffsetRangeError) Error() string {
+	return fmt.Sprintf("offset range %s: %s", e.Range, e.Message)
+}
+
+// ParseOffsetRange reads an offset range. Errors are *OffsetRangeError.
+func ParseOffsetRange(text string) (*OffsetRange, error) {
+	r := &OffsetRange{text: text}
+	invalid := &OffsetRangeError{
+		Range:   text,
+		Code:    "invalid",
+		Message: "expected an offset, A-B, A-, -N, earliest, latest or @time",
+	}
+
+	switch {
+	case strings.HasPrefix(text, "@"):
+		r.at = parseTimestamp(text[1:])
+		if r.at == nil {
+			invalid.Message = fmt.Sprintf("invalid time %q, expected RFC 3339 or seconds or milliseconds since the epoch", text[1:])
+			return nil, invalid
+		}
+		return r, nil
+	case strings.HasPrefix(text, "-"):
+		last, err := strconv.ParseInt(text[1:], 10, 64)
+		if err != nil || last <= 0 {
+			return nil, invalid
+		}
+		r.last = last
+		return r, nil
+	}
+
+	parts := strings.SplitN(text, "-", 2)
+	start, ok := parseOffsetBound(parts[0])
+	if !ok {
+		return nil, invalid
+	}
+	r.start = start
+	switch {
+	case len(parts) == 1:
+		r.end = &start
+	case parts[1] == "":
+		// open range
+	default:
+		end, ok := parseOffsetBound(parts[1])
+		if !ok {
+			return nil, invalid
+		}
+		r.end = &end
+		if start.keyword == "" && end.keyword == "" && end.offset < start.offset {
+			return nil, &OffsetRangeError{
+				Range:   text,
+				Code:    "reversed",
+				Message: fmt.Sprintf("the range ends at %d, before it starts at %d", end.offset, start.offset),
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseOffsetBound(text string) (offsetBound, bool) {
+	switch strings.ToLower(text) {
+	case "earliest", "latest":
+		return offsetBound{keyword: strings.ToLower(text)}, true
+	}
+	offset, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || offset < 0 {
+		return offsetBound{}, false
+	}
+	return offsetBound{offset: offset}, true
+}
+
+func (r *OffsetRange) String() string {
+	return r.text
+}
+
+// ResolveOffsetRange works out which offsets of a partition a range covers,
+// from start up to but not including end, trimmed to the offsets the partition
+// still holds. Ranges without an end are cut to limit messages, and other
+// ranges of more than limit messages are too_large. A time range starts at the
+// offset Kafka gives for the time, the start of the log segment it falls in,
+// so it can start a little before the time.
+func (kc KafkaConfig) ResolveOffsetRange(topic string, partition int32, r *OffsetRange, limit int64) (start int64, end int64, err error) {
+	earliest, latest, err := kc.OffsetBounds(topic, partition)
+	if err != nil {
+		return -1, -1, err
+	}
+	rangeError := func(code string, format string, args ...interface{}) error {
+		return &OffsetRangeError{
+			Range:    r.text,
+			Code:     code,
+			Message:  fmt.Sprintf(format, args...),
+			Earliest: &earliest,
+			Latest:   &latest,
+		}
+	}
+	if earliest == latest {
+		return -1, -1, rangeError("empty", "the partition holds no messages")
+	}
+
+	bound := func(b offsetBound) int64 {
+		switch b.keyword {
+		case "earliest":
+			return earliest
+		case "latest":
+			return latest - 1
+		}
+		return b.offset
+	}
+
+	open := false
+	switch {
+	case r.last > 0:
+		start, end = latest-r.last, latest
+	case r.at != nil:
+		start, err = kc.offsetAtTime(topic, partition, *r.at, earliest)
+		if err != nil {
+			return -1, -1, err
+		}
+		open = true
+	default:
+		start = bound(r.start)
+		if r.end == nil {
+			open = true
+		} else {
+			last := bound(*r.end)
+			if last < start {
+				return -1, -1, rangeError("reversed", "the range ends at %d, before it starts at %d", last, start)
+			}
+			// The offset after last, which can't go past the largest offset
+			end = last
+			if end < math.MaxInt64 {
+				end++
+			}
+		}
+	}
+
+	if start >= latest || (!open && end <= earliest) {
+		return -1, -1, rangeError("out_of_range", "offsets %s are outside the retained offsets %d-%d", describeRange(start, end, open), earliest, latest-1)
+	}
+	if start < earliest {
+		start = earliest
+	}
+	if open || end > latest {
+		end = latest
+	}
+	if end-start > limit {
+		if !open {
+			return -1, -1, rangeError("too_large", "offsets %s hold %d messages, more than the limit of %d", describeRange(start, end, false), end-start, limit)
+		}
+		end = start + limit
+	}
+	return start, end, nil
+}
+
+func describeRange(start int64, end int64, open bool) string {
+	switch {
+	case open:
+		return fmt.Sprintf("%d-", start)
+	case end-start <= 1:
+		// start+1 would overflow for the largest offset, whose end is itself
+		return strconv.FormatInt(start, 10)
+	}
+	return fmt.Sprintf("%d-%d", start, end-1)
+}
+
+// offsetAtTime asks the partition's leader for the offset of a time. Kafka
+// answers with the start of the log segment holding the time, or nothing if
+// the time is before the oldest segment, when earliest is used.
+func (kc KafkaConfig) offsetAtTime(topic string, partition int32, at time.Time, earliest int64) (int64, error) {
+	offsets, err := kc.offsetsAt(topic, partition, sarama.OffsetTime(at.UnixNano()/int64(time.Millisecond)))
+	if err == sarama.ErrOffsetOutOfRange {
+		return earliest, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return offsets[0], nil
+}
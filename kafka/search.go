@@ -0,0 +1,478 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// How many partitions a search reads at once, across all its topics
+const searchWorkers = 16
+
+// SearchOptions bound a topic search. A zero field leaves that bound off.
+type SearchOptions struct {
+	Filter       *Filter
+	TopicFilters map[string]*Filter // filters for particular topics, used instead of Filter
+	FromOffset   int64              // first offset searched in each partition
+	ToOffset     int64              // search offsets before this one, if set
+	Newest       int64              // only search the newest messages of each partition
+	MaxMatches   int                // stop once this many matches are found
+	Partitions   []int32            // only search these partitions of each topic, if set
+	Cursor       SearchCursor       // continue an earlier search that stopped early, instead of starting on the topics given
+	Progress     *SearchProgress
+}
+
+// filter returns the filter for a topic's messages
+func (options SearchOptions) filter(topic string) *Filter {
+	if filter, ok := options.TopicFilters[topic]; ok {
+		return filter
+	}
+	return options.Filter
+}
+
+// SearchCursor is where a search stopped in each partition it did not finish,
+// by topic. Searching again with it picks up where the search left off, over
+// the same window of offsets, so messages produced since do not shift the pages.
+type SearchCursor map[string]map[int32]*PartitionCursor
+
+type PartitionCursor struct {
+	Next int64 `json:"next"` // the first offset not yet searched
+	End  int64 `json:"end"`  // search offsets before this one
+}
+
+// CheckSearchCursor reports the first partition of a cursor that can't be
+// continued, such as one a client sent back altered. It does not check that the
+// partitions exist.
+func CheckSearchCursor(cursor SearchCursor) error {
+	var topics []string
+	for topic := range cursor {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		for partition, window := range cursor[topic] {
+			switch {
+			case partition < 0:
+				return fmt.Errorf("cursor: topic %s has no partition %d", topic, partition)
+			case window == nil:
+				return fmt.Errorf("cursor: topic %s partition %d has no offsets", topic, partition)
+			case window.Next < 0 || window.Next > window.End:
+				return fmt.Errorf("cursor: topic %s partition %d has offsets %d-%d out of order", topic, partition, window.Next, window.End)
+			}
+		}
+	}
+	return nil
+}
+
+// SearchProgress tracks how far a running search has read each partition.
+type SearchProgress struct {
+	lock       sync.Mutex
+	partitions map[searchPartitionKey]*PartitionProgress
+	topicErrs  map[string]string
+}
+
+type searchPartitionKey struct {
+	topic     string
+	partition int32
+}
+
+// PartitionProgress counts the offsets of a partition's search window read so far.
+type PartitionProgress struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Scanned   int64  `json:"scanned"`
+	Total     int64  `json:"total"`
+	Matches   int    `json:"matches"`
+	Error     string `json:"error,omitempty"` // why the partition's search stopped early, if it failed
+}
+
+// TopicSummary totals a search's progress over a topic's partitions.
+type TopicSummary struct {
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions"`
+	Scanned    int64  `json:"scanned"`
+	Total      int64  `json:"total"`
+	Matches    int    `json:"matches"`
+	Errors     int    `json:"errors"`          // partitions that failed
+	Error      string `json:"error,omitempty"` // why the topic could not be searched at all
+}
+
+func NewSearchProgress() *SearchProgress {
+	return &SearchProgress{
+		partitions: make(map[searchPartitionKey]*PartitionProgress),
+		topicErrs:  make(map[string]string),
+	}
+}
+
+func (p *SearchProgress) start(topic string, partition int32, total int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.partitions[searchPartitionKey{topic, partition}] = &PartitionProgress{
+		Topic:     topic,
+		Partition: partition,
+		Total:     total,
+	}
+}
+
+// update changes a partition's progress while holding the lock
+func (p *SearchProgress) update(topic string, partition int32, change func(*PartitionProgress)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if progress, ok := p.partitions[searchPartitionKey{topic, partition}]; ok {
+		change(progress)
+	}
+}
+
+func (p *SearchProgress) scanned(topic string, partition int32, scanned int64) {
+	p.update(topic, partition, func(progress *PartitionProgress) { progress.Scanned = scanned })
+}
+
+func (p *SearchProgress) matched(topic string, partition int32) {
+	p.update(topic, partition, func(progress *PartitionProgress) { progress.Matches++ })
+}
+
+func (p *SearchProgress) failed(topic string, partition int32, err error) {
+	p.update(topic, partition, func(progress *PartitionProgress) { progress.Error = err.Error() })
+}
+
+func (p *SearchProgress) topicFailed(topic string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.topicErrs[topic] = err.Error()
+}
+
+// Snapshot returns the progress of every partition, by topic and partition.
+func (p *SearchProgress) Snapshot() []PartitionProgress {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	snapshot := make([]PartitionProgress, 0, len(p.partitions))
+	for _, progress := range p.partitions {
+		snapshot = append(snapshot, *progress)
+	}
+	sort.Sort(byProgressPartition(snapshot))
+	return snapshot
+}
+
+// Topics sums the progress of each topic's partitions, by topic.
+func (p *SearchProgress) Topics() []TopicSummary {
+	partitions := p.Snapshot()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	byTopic := make(map[string]*TopicSummary)
+	summary := func(topic string) *TopicSummary {
+		if _, ok := byTopic[topic]; !ok {
+			byTopic[topic] = &TopicSummary{Topic: topic}
+		}
+		return byTopic[topic]
+	}
+	for _, partition := range partitions {
+		topic := summary(partition.Topic)
+		topic.Partitions++
+		topic.Scanned += partition.Scanned
+		topic.Total += partition.Total
+		topic.Matches += partition.Matches
+		if partition.Error != "" {
+			topic.Errors++
+		}
+	}
+	for topic, err := range p.topicErrs {
+		summary(topic).Error = err
+	}
+
+	summaries := make([]TopicSummary, 0, len(byTopic))
+	for _, topic := range byTopic {
+		summaries = append(summaries, *topic)
+	}
+	sort.Sort(byTopicSummary(summaries))
+	return summaries
+}
+
+type byProgressPartition []PartitionProgress
+
+func (p byProgressPartition) Len() int      { return len(p) }
+func (p byProgressPartition) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byProgressPartition) Less(i, j int) bool {
+	if p[i].Topic != p[j].Topic {
+		return p[i].Topic < p[j].Topic
+	}
+	return p[i].Partition < p[j].Partition
+}
+
+type byTopicSummary []TopicSummary
+
+func (t byTopicSummary) Len() int           { return len(t) }
+func (t byTopicSummary) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byTopicSummary) Less(i, j int) bool { return t[i].Topic < t[j].Topic }
+
+type MessageMatch struct {
+	Keyword   string        `json:"keyword"` // the search filter
+	Topic     string        `json:"topic"`
+	Partition int32         `json:"partition"`
+	Offset    int64         `json:"offset"`
+	Key       *DecodedValue `json:"key,omitempty"`
+	Tombstone bool          `json:"tombstone,omitempty"` // the message has a key and no value, deleting the key from a compacted topic
+	DecodedValue
+}
+
+// MatchingTopics returns the names of the cluster's topics that match pattern, sorted.
+// Only the topic names are asked for, not their partitions' offsets.
+func (kc KafkaConfig) MatchingTopics(pattern *regexp.Regexp) ([]string, error) {
+	metadata, err := kc.getMetadata(&sarama.MetadataRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, topic := range metadata.Topics {
+		if pattern.MatchString(topic.Name) {
+			names = append(names, topic.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// searchJob is one partition for a search worker to read
+type searchJob struct {
+	topic     string
+	partition int32
+	window    PartitionCursor
+}
+
+// SearchTopics sends the messages of the topics that pass the search's filter on
+// found, reading up to searchWorkers partitions at once. If the search stops before
+// reaching the end of its window, because it found MaxMatches or stopSearch was
+// closed, the returned cursor holds where to continue. It is nil once every
+// partition is finished. A topic that can't be searched is recorded in the
+// progress and does not stop the others.
+func (kc KafkaConfig) SearchTopics(found chan MessageMatch, stopSearch chan struct{}, topics []string, options SearchOptions) SearchCursor {
+	progress := options.Progress
+	if progress == nil {
+		progress = NewSearchProgress()
+	}
+
+	windows := options.Cursor
+	if windows == nil {
+		windows = SearchCursor{}
+		for _, topic := range topics {
+			topicWindows, err := kc.searchWindows(topic, options)
+			if err != nil {
+				progress.topicFailed(topic, err)
+				continue
+			}
+			windows[topic] = topicWindows
+		}
+	}
+
+	var jobs []searchJob
+	for topic, topicWindows := range windows {
+		for partition, window := range topicWindows {
+			if window == nil {
+				continue
+			}
+			progress.start(topic, partition, window.End-window.Next)
+			jobs = append(jobs, searchJob{topic: topic, partition: partition, window: *window})
+		}
+	}
+
+	queue := make(chan searchJob)
+	limit := &searchLimit{max: options.MaxMatches}
+	cursor := SearchCursor{}
+	var cursorLock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < searchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				next, err := kc.searchPartition(found, stopSearch, options.filter(job.topic), job, limit, progress)
+				if err != nil {
+					progress.failed(job.topic, job.partition, err)
+				}
+				progress.scanned(job.topic, job.partition, next-job.window.Next)
+				if next < job.window.End {
+					cursorLock.Lock()
+					if cursor[job.topic] == nil {
+						cursor[job.topic] = make(map[int32]*PartitionCursor)
+					}
+					cursor[job.topic][job.partition] = &PartitionCursor{Next: next, End: job.window.End}
+					cursorLock.Unlock()
+				}
+			}
+		}()
+	}
+	// Jobs left when the search stops are returned at once, so they still reach the cursor
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(cursor) == 0 {
+		return nil
+	}
+	return cursor
+}
+
+// collectMatches runs a search and returns all its matches, stopping it early
+// if it takes longer than timeout. truncated is set if the search did not finish.
+func (kc KafkaConfig) collectMatches(topics []string, options SearchOptions, timeout time.Duration) (matches []MessageMatch, truncated bool) {
+	found := make(chan MessageMatch)
+	stopSearch := make(chan struct{})
+	finished := make(chan SearchCursor)
+	go func() {
+		finished <- kc.SearchTopics(found, stopSearch, topics, options)
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timedOut = time.After(timeout)
+	}
+
+	for {
+		select {
+		case match := <-found:
+			matches = append(matches, match)
+		case <-timedOut:
+			close(stopSearch)
+			timedOut = nil
+		case cursor := <-finished:
+			return matches, cursor != nil
+		}
+	}
+}
+
+// searchWindows works out which offsets of each partition a new search reads
+func (kc KafkaConfig) searchWindows(topic string, options SearchOptions) (map[int32]*PartitionCursor, error) {
+	partitions, err := kc.client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	if options.Partitions != nil {
+		numPartitions := int32(len(partitions))
+		partitions = options.Partitions
+		for _, partition := range partitions {
+			if partition < 0 || partition >= numPartitions {
+				return nil, sarama.ErrUnknownTopicOrPartition
+			}
+		}
+	}
+
+	filterStart, filterEnd := options.filter(topic).OffsetRange()
+	windows := make(map[int32]*PartitionCursor)
+	for _, partition := range partitions {
+		earliest, latest, err := kc.OffsetBounds(topic, partition)
+		if err != nil {
+			return nil, err
+		}
+
+		start, end := maxInt64(earliest, filterStart), minInt64(latest, filterEnd)
+		start = maxInt64(start, options.FromOffset)
+		if options.ToOffset > 0 {
+			end = minInt64(end, options.ToOffset)
+		}
+		if options.Newest > 0 {
+			start = maxInt64(start, latest-options.Newest)
+		}
+		if start < end {
+			windows[partition] = &PartitionCursor{Next: start, End: end}
+		}
+	}
+	return windows, nil
+}
+
+// searchLimit counts the matches of a search across its partitions
+type searchLimit struct {
+	lock  sync.Mutex
+	max   int
+	count int
+}
+
+// take claims a place for one more match, or returns false if the search has enough
+func (l *searchLimit) take() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.count >= l.max {
+		return false
+	}
+	l.count++
+	return true
+}
+
+func (l *searchLimit) full() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.max > 0 && l.count >= l.max
+}
+
+// searchPartition sends the messages in the partition's window that pass the filter,
+// until the window ends, the limit is reached or stopSearch is closed. It returns
+// the first offset it did not search.
+func (kc KafkaConfig) searchPartition(found chan MessageMatch, stopSearch chan struct{}, filter *Filter, job searchJob, limit *searchLimit, progress *SearchProgress) (int64, error) {
+	topic, partition, window := job.topic, job.partition, job.window
+	if window.Next >= window.End {
+		return window.End, nil
+	}
+	select {
+	case <-stopSearch:
+		return window.Next, nil
+	default:
+	}
+	if limit.full() {
+		return window.Next, nil
+	}
+
+	next, err := kc.fetchRange(topic, partition, window.Next, window.End, stopSearch, func(input *filterInput) bool {
+		if limit.full() {
+			return false
+		}
+
+		message := input.message
+		if filter.match(input) {
+			if !limit.take() {
+				return false
+			}
+			match := MessageMatch{
+				Keyword:      filter.String(),
+				Topic:        topic,
+				Partition:    partition,
+				Offset:       message.Offset,
+				Key:          input.decodedKey(),
+				Tombstone:    message.Key != nil && message.Value == nil,
+				DecodedValue: *input.decodedValue(),
+			}
+			select {
+			case found <- match:
+				progress.matched(topic, partition)
+			case <-stopSearch:
+				return false
+			}
+		}
+
+		progress.scanned(topic, partition, message.Offset+1-window.Next)
+		return true
+	})
+	if err == nil && next < window.End {
+		select {
+		case <-stopSearch:
+		default:
+			if !limit.full() {
+				// The log ended before the window did, so there is nothing left to search
+				next = window.End
+			}
+		}
+	}
+	return next, err
+}
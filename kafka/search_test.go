@@ -0,0 +1,46 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckSearchCursor(t *testing.T) {
+	tests := []struct {
+		cursor string
+		valid  bool
+	}{
+		{`{"orders": {"0": {"next": 5, "end": 10}, "3": {"next": 10, "end": 10}}}`, true},
+		{`{}`, true},
+		{`{"orders": {"0": null}}`, false},
+		{`{"orders": {"0": {"next": -1, "end": 10}}}`, false},
+		{`{"orders": {"0": {"next": 11, "end": 10}}}`, false},
+		{`{"orders": {"-2": {"next": 0, "end": 10}}}`, false},
+	}
+	for _, test := range tests {
+		var cursor SearchCursor
+		if err := json.Unmarshal([]byte(test.cursor), &cursor); err != nil {
+			t.Errorf("decoding %s: %s", test.cursor, err)
+			continue
+		}
+		err := CheckSearchCursor(cursor)
+		if test.valid && err != nil {
+			t.Errorf("CheckSearchCursor(%s): %s", test.cursor, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("CheckSearchCursor(%s) succeeded, want an error", test.cursor)
+		}
+	}
+}
+
+func TestSearchTopicsSkipsMissingWindows(t *testing.T) {
+	var cursor SearchCursor
+	if err := json.Unmarshal([]byte(`{"orders": {"0": null}}`), &cursor); err != nil {
+		t.Fatal(err)
+	}
+	found := make(chan MessageMatch)
+	var kc KafkaConfig
+	if next := kc.SearchTopics(found, make(chan struct{}), nil, SearchOptions{Cursor: cursor}); len(next) != 0 {
+		t.Errorf("SearchTopics returned cursor %v, want none", next)
+	}
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// How many tail events may wait for a slow client before new messages are dropped
+const tailBuffer = 100
+
+// TailOptions choose what a tail streams.
+type TailOptions struct {
+	Partition int32          // -1 for every partition
+	Offset    int64          // where to start: sarama.OffsetNewest, sarama.OffsetOldest or an offset
+	Filter    *regexp.Regexp // only send messages whose decoded value or key matches, if set
+	MaxRate   int            // most messages sent per second, 0 for no limit
+}
+
+// ParseTailOffset reads where a tail starts: newest (the default), oldest or an offset.
+func ParseTailOffset(offset string) (int64, error) {
+	switch strings.ToLower(offset) {
+	case "", "newest":
+		return sarama.OffsetNewest, nil
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	}
+	o, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || o < 0 {
+		return sarama.OffsetNewest, fmt.Errorf("invalid offset %q, expected newest, oldest or an offset", offset)
+	}
+	return o, nil
+}
+
+// TailMessage is a message event of a tail.
+type TailMessage struct {
+	Type      string        `json:"type"` // always message
+	Topic     string        `json:"topic"`
+	Partition int32         `json:"partition"`
+	Offset    int64         `json:"offset"`
+	Key       *DecodedValue `json:"key,omitempty"`
+	DecodedValue
+}
+
+// TailNotice tells a tail's client about messages it did not get: how many were
+// dropped because it fell behind or went over the rate, or a consumer error.
+type TailNotice struct {
+	Type      string `json:"type"` // dropped or error
+	Dropped   int    `json:"dropped,omitempty"`
+	Partition int32  `json:"partition"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Tail streams messages as they arrive on the topic until stop is closed,
+// as *TailMessage and *TailNotice events on the returned channel, which is
+// closed once the consumers have stopped. The consumers are never blocked by
+// the reader: events that don't fit in the channel are dropped and counted
+// in a later dropped notice.
+func (kc KafkaConfig) Tail(topic string, options TailOptions, stop <-chan struct{}) (<-chan interface{}, error) {
+	partitions := []int32{options.Partition}
+	if options.Partition < 0 {
+		var err error
+		partitions, err = kc.client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(kc.client)
+	if err != nil {
+		return nil, err
+	}
+
+	var consumers []sarama.PartitionConsumer
+	for _, partition := range partitions {
+		partitionConsumer, err := consumer.ConsumePartition(topic, partition, options.Offset)
+		if err != nil {
+			for _, started := range consumers {
+				started.Close()
+			}
+			consumer.Close()
+			return nil, err
+		}
+		consumers = append(consumers, partitionConsumer)
+	}
+
+	events := make(chan interface{}, tailBuffer)
+	go kc.tail(consumers, options, events, stop, func() {
+		for _, partitionConsumer := range consumers {
+			partitionConsumer.Close()
+		}
+		consumer.Close()
+	})
+	return events, nil
+}
+
+func (kc KafkaConfig) tail(consumers []sarama.PartitionConsumer, options TailOptions, events chan interface{}, stop <-chan struct{}, closeConsumers func()) {
+	defer close(events)
+
+	// Merge the partitions, so one loop decides what reaches the client
+	done := make(chan struct{})
+	messages := make(chan *sarama.ConsumerMessage)
+	errors := make(chan *sarama.ConsumerError)
+	for _, partitionConsumer := range consumers {
+		go func(partitionConsumer sarama.PartitionConsumer) {
+			for {
+				select {
+				case message := <-partitionConsumer.Messages():
+					select {
+					case messages <- message:
+					case <-done:
+						return
+					}
+				case err := <-partitionConsumer.Errors():
+					select {
+					case errors <- err:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}(partitionConsumer)
+	}
+	defer closeConsumers()
+	defer close(done)
+
+	limit := newRateLimit(options.MaxRate)
+	dropped := make(map[int32]int)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	// offer sends an event if the client has room for it
+	offer := func(event interface{}) bool {
+		select {
+		case events <- event:
+			return true
+		default:
+			return false
+		}
+	}
+	flushDropped := func() {
+		for partition, count := range dropped {
+			if !offer(&TailNotice{Type: "dropped", Partition: partition, Dropped: count}) {
+				return
+			}
+			delete(dropped, partition)
+		}
+	}
+
+	for {
+		select {
+		case message := <-messages:
+			event := &TailMessage{
+				Type:         "message",
+				Topic:        message.Topic,
+				Partition:    message.Partition,
+				Offset:       message.Offset,
+				Key:          kc.decoders.DecodeKey(message.Topic, message.Key),
+				DecodedValue: kc.decoders.Decode(message.Topic, message.Value),
+			}
+			if options.Filter != nil && !tailMatch(options.Filter, event) {
+				continue
+			}
+
+			flushDropped()
+			if !limit.allow() || !offer(event) {
+				dropped[message.Partition]++
+			}
+		case err := <-errors:
+			if !offer(&TailNotice{Type: "error", Partition: err.Partition, Error: err.Err.Error()}) {
+				dropped[err.Partition]++
+			}
+		case <-flush.C:
+			flushDropped()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func tailMatch(filter *regexp.Regexp, message *TailMessage) bool {
+	if filter.MatchString(message.Message) {
+		return true
+	}
+	return message.Key != nil && filter.MatchString(message.Key.Message)
+}
+
+// rateLimit allows up to max events in each second, or any number if max is 0
+type rateLimit struct {
+	max         int
+	count       int
+	windowStart time.Time
+}
+
+func newRateLimit(max int) *rateLimit {
+	return &rateLimit{max: max, windowStart: time.Now()}
+}
+
+func (r *rateLimit) allow() bool {
+	if r.max <= 0 {
+		return true
+	}
+	if now := time.Now(); now.Sub(r.windowStart) >= time.Second {
+		r.windowStart = now
+		r.count = 0
+	}
+	if r.count >= r.max {
+		return false
+	}
+	r.count++
+	return true
+}
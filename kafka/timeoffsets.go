@@ -0,0 +1,183 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shopify/sarama"
+)
+
+// TimeOffsetOptions choose how closely OffsetsForTime finds a time's offsets.
+type TimeOffsetOptions struct {
+	TimeField string        // field of each message holding its time, as in search filters, to refine the broker's answer with, if set
+	MaxScan   int64         // most messages read per partition while refining, if set
+	Timeout   time.Duration // stop refining after this long, if set
+}
+
+// TimeOffsets are the offsets of each partition of a topic at a time.
+type TimeOffsets struct {
+	Topic      string                `json:"topic"`
+	Time       time.Time             `json:"time"`
+	TimeField  string                `json:"time_field,omitempty"`
+	Partitions []PartitionTimeOffset `json:"partitions"`
+}
+
+// PartitionTimeOffset is the offset of a partition at a time. BrokerOffset is
+// Kafka's answer, the start of the log segment the time falls in. If messages
+// were read to refine it, Offset is the first message at or after the time,
+// or the end of the log if there is none; otherwise it is BrokerOffset.
+type PartitionTimeOffset struct {
+	Partition    int32      `json:"partition"`
+	Offset       int64      `json:"offset"`
+	BrokerOffset int64      `json:"broker_offset"`
+	Refined      bool       `json:"refined"`             // Offset was found from message times
+	Timestamp    *time.Time `json:"timestamp,omitempty"` // of the message at Offset, when refined
+	Scanned      int64      `json:"scanned"`
+	Truncated    bool       `json:"truncated,omitempty"` // refining stopped at the timeout or scan limit before finding the time
+	Error        string     `json:"error,omitempty"`
+
+	latest int64
+}
+
+// ParseTime reads a time written in RFC 3339, or as seconds or milliseconds since the epoch.
+func ParseTime(text string) (time.Time, error) {
+	t := parseTimestamp(text)
+	if t == nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or seconds or milliseconds since the epoch", text)
+	}
+	return *t, nil
+}
+
+// CheckTimeField reports whether a time field is written as search filters expect.
+func CheckTimeField(field string) error {
+	_, err := parseFilterField(field)
+	return err
+}
+
+// OffsetsForTime finds each partition's offset at a time. Each leader is asked
+// for its partitions' earliest, latest and time offsets, an OffsetRequest for
+// each as a request holds one time per partition, and if the options name a
+// time field, each partition is then read forward from the broker's offset to
+// the first message whose time field is at or after the time.
+func (kc KafkaConfig) OffsetsForTime(topic string, at time.Time, options TimeOffsetOptions) (*TimeOffsets, error) {
+	var timeField *filterField
+	if options.TimeField != "" {
+		field, err := parseFilterField(options.TimeField)
+		if err != nil {
+			return nil, err
+		}
+		timeField = &field
+	}
+
+	metadata, err := kc.getMetadata(&sarama.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.Topics) != 1 {
+		return nil, sarama.ErrIncompleteResponse
+	}
+	if metadata.Topics[0].Err != sarama.ErrNoError {
+		return nil, metadata.Topics[0].Err
+	}
+
+	// The time is asked for last, so the earliest and latest offsets are read
+	// even when it has no offset
+	offsets := kc.leaderOffsets(metadata, sarama.EarliestOffset, sarama.LatestOffsets, sarama.OffsetTime(at.UnixNano()/int64(time.Millisecond)))
+
+	result := &TimeOffsets{Topic: topic, Time: at, TimeField: options.TimeField, Partitions: []PartitionTimeOffset{}}
+	for _, partition := range metadata.Topics[0].Partitions {
+		read := offsets[topicPartition{topic, partition.ID}]
+		offset := PartitionTimeOffset{Partition: partition.ID}
+		switch read.err {
+		case nil:
+			offset.BrokerOffset = read.offsets[2]
+		case sarama.ErrOffsetOutOfRange:
+			// The time is before the oldest segment
+			offset.BrokerOffset = read.offsets[0]
+		default:
+			offset.Error = read.err.Error()
+		}
+		offset.latest = read.offsets[1]
+		offset.Offset = offset.BrokerOffset
+		result.Partitions = append(result.Partitions, offset)
+	}
+	sort.Sort(timeOffsetsByPartition(result.Partitions))
+
+	if timeField != nil {
+		kc.refineTimeOffsets(topic, at, *timeField, options, result.Partitions)
+	}
+	return result, nil
+}
+
+// refineTimeOffsets reads each partition from its broker offset to the first
+// message at or after the time, up to searchWorkers partitions at once
+func (kc KafkaConfig) refineTimeOffsets(topic string, at time.Time, timeField filterField, options TimeOffsetOptions, partitions []PartitionTimeOffset) {
+	stop := make(chan struct{})
+	if options.Timeout > 0 {
+		timer := time.AfterFunc(options.Timeout, func() { close(stop) })
+		defer timer.Stop()
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < searchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				kc.refineTimeOffset(topic, at, timeField, options.MaxScan, &partitions[i], stop)
+			}
+		}()
+	}
+	for i := range partitions {
+		if partitions[i].Error == "" {
+			queue <- i
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (kc KafkaConfig) refineTimeOffset(topic string, at time.Time, timeField filterField, maxScan int64, offset *PartitionTimeOffset, stop <-chan struct{}) {
+	end := offset.latest
+	if maxScan > 0 && maxScan < end-offset.BrokerOffset {
+		end = offset.BrokerOffset + maxScan
+	}
+
+	found := false
+	next, err := kc.fetchRange(topic, offset.Partition, offset.BrokerOffset, end, stop, func(input *filterInput) bool {
+		offset.Scanned++
+		value, ok := input.field(timeField)
+		if !ok {
+			return true
+		}
+		if t := valueTime(value); t != nil && !t.Before(at) {
+			offset.Offset = input.message.Offset
+			offset.Timestamp = t
+			found = true
+			return false
+		}
+		return true
+	})
+	switch {
+	case err != nil:
+		offset.Error = err.Error()
+	case found:
+		offset.Refined = true
+	case next >= offset.latest:
+		// Every message left is before the time, so the offset is the end of the log
+		offset.Offset = offset.latest
+		offset.Refined = true
+	default:
+		// Stopped by the timeout, or at end when maxScan cut it short
+		offset.Truncated = true
+	}
+}
+
+type timeOffsetsByPartition []PartitionTimeOffset
+
+func (p timeOffsetsByPartition) Len() int           { return len(p) }
+func (p timeOffsetsByPartition) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p timeOffsetsByPartition) Less(i, j int) bool { return p[i].Partition < p[j].Partition }
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TraceTopic is a topic an entity passes through, and where its messages hold
+// the entity's ID and the time of the event. Fields are written as in search
+// filters: value.order_id, .order.id, key or key.id.
+type TraceTopic struct {
+	Topic     string
+	IDField   string
+	TimeField string // optional
+}
+
+// TraceOptions bound a trace's search of each topic.
+type TraceOptions struct {
+	Newest  int64         // only search the newest messages of each partition, if set
+	MaxHops int           // stop once this many messages are found, if set
+	Timeout time.Duration // return what was found so far after this long, if set
+}
+
+// Trace is the timeline of an entity's messages across its topics.
+type Trace struct {
+	ID        string         `json:"id"`
+	OrderedBy string         `json:"ordered_by"` // timestamp, or topic if some hops have no timestamp
+	Truncated bool           `json:"truncated"`  // the search stopped at MaxHops or the timeout
+	Hops      []TraceHop     `json:"hops"`
+	Topics    []TopicSummary `json:"topics"`
+}
+
+// TraceHop is one message of a trace, with where to find it.
+type TraceHop struct {
+	Topic     string        `json:"topic"`
+	Partition int32         `json:"partition"`
+	Offset    int64         `json:"offset"`
+	Timestamp *time.Time    `json:"timestamp,omitempty"`
+	Key       *DecodedValue `json:"key,omitempty"`
+	DecodedValue
+
+	topicIndex int
+}
+
+// CheckTraceTopics reports the first trace topic whose fields can't be used.
+func CheckTraceTopics(topics []TraceTopic) error {
+	for _, topic := range topics {
+		_, err := traceFilter(topic, "id")
+		if err != nil {
+			return fmt.Errorf("topic %s: %s", topic.Topic, err.Error())
+		}
+		if topic.TimeField != "" {
+			_, err = parseFilterField(topic.TimeField)
+			if err != nil {
+				return fmt.Errorf("topic %s: %s", topic.Topic, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// traceFilter matches the messages of a trace topic that carry the ID
+func traceFilter(topic TraceTopic, id string) (*Filter, error) {
+	return parseFilterExpression(fmt.Sprintf("%s = %s", topic.IDField, strconv.Quote(id)))
+}
+
+// Trace finds the messages with the ID in each of the topics and orders them by
+// their timestamps. If any hop lacks a timestamp, hops are ordered by the order
+// of the topics instead, and by timestamp or offset within a topic.
+func (kc KafkaConfig) Trace(id string, topics []TraceTopic, options TraceOptions) (*Trace, error) {
+	searchOptions := SearchOptions{
+		TopicFilters: make(map[string]*Filter),
+		Newest:       options.Newest,
+		MaxMatches:   options.MaxHops,
+		Progress:     NewSearchProgress(),
+	}
+	names := make([]string, len(topics))
+	order := make(map[string]int)
+	for i, topic := range topics {
+		filter, err := traceFilter(topic, id)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %s", topic.Topic, err.Error())
+		}
+		searchOptions.TopicFilters[topic.Topic] = filter
+		names[i] = topic.Topic
+		order[topic.Topic] = i
+	}
+
+	matches, truncated := kc.collectMatches(names, searchOptions, options.Timeout)
+
+	trace := &Trace{ID: id, OrderedBy: "timestamp", Truncated: truncated, Hops: []TraceHop{}}
+	for _, match := range matches {
+		i := order[match.Topic]
+		hop := TraceHop{
+			Topic:        match.Topic,
+			Partition:    match.Partition,
+			Offset:       match.Offset,
+			Key:          match.Key,
+			DecodedValue: match.DecodedValue,
+			topicIndex:   i,
+		}
+		if topics[i].TimeField != "" {
+			hop.Timestamp = matchTime(match, topics[i].TimeField)
+		}
+		trace.Hops = append(trace.Hops, hop)
+	}
+
+	for _, hop := range trace.Hops {
+		if hop.Timestamp == nil {
+			trace.OrderedBy = "topic"
+		}
+	}
+	sort.Sort(traceTimeline{hops: trace.Hops, byTopic: trace.OrderedBy == "topic"})
+	trace.Topics = searchOptions.Progress.Topics()
+	return trace, nil
+}
+
+// matchTime reads a timestamp from a field of a matched message: an RFC 3339
+// string, or a number of seconds or, if it is too big for seconds, milliseconds
+// since the epoch. It returns nil if the field is missing or isn't a time.
+func matchTime(match MessageMatch, field string) *time.Time {
+	timeField, err := parseFilterField(field)
+	if err != nil {
+		return nil
+	}
+
+	text := match.Message
+	if timeField.source == "key" {
+		if match.Key == nil {
+			return nil
+		}
+		text = match.Key.Message
+	}
+	value := interface{}(text)
+	if timeField.path != nil {
+		var ok bool
+		value, ok = jsonPath(parseFilterJSON(text), timeField.path)
+		if !ok {
+			return nil
+		}
+	}
+	return valueTime(value)
+}
+
+// valueTime reads a timestamp from a field value, or returns nil if it isn't one
+func valueTime(value interface{}) *time.Time {
+	switch v := value.(type) {
+	case json.Number:
+		return epochTime(v.String())
+	case string:
+		return parseTimestamp(v)
+	}
+	return nil
+}
+
+// parseTimestamp reads an RFC 3339 time, or a number of seconds or
+// milliseconds since the epoch, returning nil if text isn't a time
+func parseTimestamp(text string) *time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, text); err == nil {
+			return &t
+		}
+	}
+	return epochTime(text)
+}
+
+func epochTime(number string) *time.Time {
+	// Seconds since the epoch pass 1e12 in the year 33658, so bigger numbers are milliseconds
+	if whole, err := strconv.ParseInt(number, 10, 64); err == nil {
+		t := time.Unix(whole, 0).UTC()
+		if whole > 1e12 {
+			t = time.Unix(0, whole*int64(time.Millisecond)).UTC()
+		}
+		return &t
+	}
+
+	seconds, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return nil
+	}
+	if seconds > 1e12 {
+		seconds /= 1000
+	}
+	t := time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+	return &t
+}
+
+// traceTimeline sorts hops by timestamp, or by topic order first
+type traceTimeline struct {
+	hops    []TraceHop
+	byTopic bool
+}
+
+func (t traceTimeline) Len() int      { return len(t.hops) }
+func (t traceTimeline) Swap(i, j int) { t.hops[i], t.hops[j] = t.hops[j], t.hops[i] }
+func (t traceTimeline) Less(i, j int) bool {
+	a, b := t.hops[i], t.hops[j]
+	if t.byTopic && a.topicIndex != b.topicIndex {
+		return a.topicIndex < b.topicIndex
+	}
+	if a.Timestamp != nil && b.Timestamp != nil && !a.Timestamp.Equal(*b.Timestamp) {
+		return a.Timestamp.Before(*b.Timestamp)
+	}
+	if a.topicIndex != b.topicIndex {
+		return a.topicIndex < b.topicIndex
+	}
+	if a.Partition != b.Partition {
+		return a.Partition < b.Partition
+	}
+	return a.Offset < b.Offset
+}
@@ -1,32 +1,51 @@
 package main
 
 import (
-	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/shopify/sarama"
 	"github.com/trotha01/kafka-viz/kafka"
 	"golang.org/x/net/websocket"
 )
 
 type config struct {
-	host           string
-	port           string
-	logDir         string
-	logFile        string
-	kafkaBinDir    string
-	kafkaConfigDir string
-	kafkaHost      string
-	kafkaPort      string
-	permissions    string
+	host            string
+	port            string
+	logDir          string
+	logFile         string
+	kafkaBinDir     string
+	kafkaConfigDir  string
+	kafkaHost       string
+	kafkaPort       string
+	kafkaBrokers    string
+	permissions     string
+	pollInterval    string
+	topicDecoders   string
+	avroSchemaDir   string
+	schemaRegistry  string
+	protoDescriptor string
+	protoTopics     string
+	traceTopics     string
+	traceTimestamps string
+	partitioners    string
+	messageCacheMB  string
+	timeFields      string
 }
 
 var conf *config
@@ -41,97 +60,937 @@ func init() {
 func main() {
 	rtc := mux.NewRouter()
 
-	kafka, err := client.NewKafka(conf.kafkaHost, conf.kafkaPort)
+	brokers := parseBrokers(conf.kafkaBrokers)
+	if len(brokers) == 0 {
+		logger.Printf("Invalid KAFKA_BROKERS %q: no brokers listed", conf.kafkaBrokers)
+		os.Exit(1)
+	}
+
+	kafka, err := client.NewKafka(brokers)
 	if err != nil {
 		logger.Printf("Error creating kafka connections: %s", err.Error())
 		os.Exit(1)
 	}
-	defer kafka.Close()
+	defer kafka.Close()
+
+	pollInterval, err := time.ParseDuration(conf.pollInterval)
+	if err != nil {
+		logger.Printf("Invalid poll interval %q: %s", conf.pollInterval, err.Error())
+		os.Exit(1)
+	}
+	if pollInterval <= 0 {
+		logger.Printf("Invalid poll interval %q: must be positive", conf.pollInterval)
+		os.Exit(1)
+	}
+	pollHub := client.NewPollHub(kafka, pollInterval)
+
+	cacheMB, err := strconv.ParseInt(conf.messageCacheMB, 10, 64)
+	if err != nil || cacheMB < 0 || cacheMB > math.MaxInt64>>20 {
+		logger.Printf("Invalid MESSAGE_CACHE_MB %q", conf.messageCacheMB)
+		os.Exit(1)
+	}
+	kafka.SetCacheSize(cacheMB << 20)
+
+	if conf.avroSchemaDir != "" || conf.schemaRegistry != "" {
+		kafka.Decoders().Register(client.NewAvroDecoder(conf.avroSchemaDir, conf.schemaRegistry), true)
+	}
+
+	if conf.protoDescriptor != "" {
+		err = registerProtobuf(kafka.Decoders(), conf.protoDescriptor, conf.protoTopics)
+		if err != nil {
+			logger.Printf("Error loading protobuf descriptors: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	err = setTopicDecoders(kafka.Decoders(), conf.topicDecoders)
+	if err != nil {
+		logger.Printf("Invalid TOPIC_DECODERS %q: %s", conf.topicDecoders, err.Error())
+		os.Exit(1)
+	}
+
+	traceTopics, err := parseTraceTopics(conf.traceTopics, conf.traceTimestamps)
+	if err != nil {
+		logger.Printf("Invalid trace settings: %s", err.Error())
+		os.Exit(1)
+	}
+
+	partitioners, err := parseKeyPartitioners(conf.partitioners)
+	if err != nil {
+		logger.Printf("Invalid TOPIC_PARTITIONERS %q: %s", conf.partitioners, err.Error())
+		os.Exit(1)
+	}
+
+	timeFields, err := parseTimeFields(conf.timeFields)
+	if err != nil {
+		logger.Printf("Invalid TOPIC_TIMESTAMPS %q: %s", conf.timeFields, err.Error())
+		os.Exit(1)
+	}
+
+	if strings.Contains(conf.permissions, "R") {
+		rtc.HandleFunc("/topics", topicDataHandler(kafka))                                   // get metadata
+		rtc.Handle("/topics/{topic}/poll", websocket.Handler(pollTopic(pollHub)))            // poll for topic metadata
+		rtc.Handle("/topics/{topic}/tail", websocket.Handler(tailHandler(kafka)))            // stream new messages
+		rtc.Handle("/search", websocket.Handler(socketSearchHandler(kafka)))                 // search data
+		rtc.HandleFunc("/topics/{topic}/keys/{key}", keyLookupHandler(kafka, partitioners))  // find every version of a key
+		rtc.HandleFunc("/topics/{topic}/offsets", timeOffsetsHandler(kafka, timeFields))     // find offsets by time
+		rtc.HandleFunc("/topics/{topic}/{partition}/{offsetRange}", consumerHandler(kafka))  // get specific data
+		rtc.HandleFunc("/groups/{group}", groupLagHandler(kafka))                            // get consumer group lag
+		rtc.HandleFunc("/health/cluster", clusterHealthHandler(kafka))                       // get partition health
+		rtc.HandleFunc("/health/brokers", brokerStatusHandler(kafka))                        // get broker connection state
+		rtc.HandleFunc("/health/cache", cacheStatsHandler(kafka))                            // get message cache hit rate and size
+		rtc.HandleFunc("/decoders", decodersHandler(kafka))                                  // list message decoders
+		rtc.HandleFunc("/topics/{topic}/decoder", topicDecoderHandler(kafka)).Methods("GET") // get a topic's decoder
+		rtc.HandleFunc("/trace/{id}", traceHandler(kafka, traceTopics))                      // follow an ID across topics
+	}
+
+	if strings.Contains(conf.permissions, "W") {
+		rtc.HandleFunc("/topics/{topic}", producerHandler(kafka))                                // insert data
+		rtc.HandleFunc("/topics/{topic}/bulk", bulkProducerHandler(kafka))                       // insert data from a file
+		rtc.HandleFunc("/groups/{group}/offsets", offsetResetHandler(kafka))                     // move consumer group offsets
+		rtc.HandleFunc("/topics/{topic}/decoder", setTopicDecoderHandler(kafka)).Methods("POST") // set a topic's decoder
+	} else {
+		rtc.HandleFunc("/topics/{topic}/decoder", writeForbiddenHandler).Methods("POST") // decoders are server-wide, so setting one is a write
+	}
+
+	rtc.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/kafka_viz")))
+
+	bind := fmt.Sprintf("%s:%s", conf.host, conf.port)
+	logger.Printf("Listening on %s...", bind)
+
+	err = http.ListenAndServe(bind, rtc)
+	if err != nil {
+		logger.Printf("Error serving: %s", err.Error())
+		cleanup()
+		os.Exit(1)
+	}
+}
+
+func topicDataHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		topics := r.Form["topic"]
+		logger.Printf("Call for topic metadata. Topics: %s", topics)
+
+		metadataResponse, err := kafka.TopicDataResponse(topics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(metadataResponse)
+	}
+}
+
+// Defaults for a trace's bounds, which the query can change
+const (
+	traceMaxHops = 1000
+	traceTimeout = 30 * time.Second
+)
+
+// traceHandler returns the messages carrying an ID in the trace topics, as a
+// timeline. The query may set newest (messages per partition to search),
+// limit (most hops) and timeout (a Go duration).
+func traceHandler(kafka *client.KafkaConfig, topics []client.TraceTopic) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		logger.Printf("Call for trace of %s", id)
+
+		if len(topics) == 0 {
+			http.Error(w, "no trace topics are configured, set TRACE_TOPICS", http.StatusNotFound)
+			return
+		}
+
+		options := client.TraceOptions{MaxHops: traceMaxHops, Timeout: traceTimeout}
+		err := searchBounds(r.URL.Query(), &options.Newest, &options.MaxHops, &options.Timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		trace, err := kafka.Trace(id, topics, options)
+		if err != nil {
+			logger.Printf("Error tracing %s: %s", id, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := json.Marshal(trace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// searchBounds reads the bounds of a search from a query into newest, limit
+// and timeout, leaving each as it is if the query does not set it.
+func searchBounds(query url.Values, newest *int64, limit *int, timeout *time.Duration) error {
+	var err error
+	if text := query.Get("newest"); text != "" {
+		*newest, err = strconv.ParseInt(text, 10, 64)
+		if err != nil || *newest < 0 {
+			return fmt.Errorf("invalid newest %q", text)
+		}
+	}
+	if text := query.Get("limit"); text != "" {
+		*limit, err = strconv.Atoi(text)
+		if err != nil || *limit < 0 {
+			return fmt.Errorf("invalid limit %q", text)
+		}
+	}
+	if text := query.Get("timeout"); text != "" {
+		*timeout, err = time.ParseDuration(text)
+		if err != nil || *timeout < 0 {
+			return fmt.Errorf("invalid timeout %q", text)
+		}
+	}
+	return nil
+}
+
+// Defaults for a key lookup's bounds, which the query can change
+const (
+	keyLookupMaxVersions = 1000
+	keyLookupTimeout     = 30 * time.Second
+)
+
+// keyLookupHandler returns every message with a key, searching only the
+// partition the topic's partitioner sends it to. The query may set
+// partitioner (hash, murmur2 or none) to override the topic's setting,
+// partition to search one partition, encoding (text, hex or base64) for
+// binary keys, and newest, limit and timeout as for a trace.
+func keyLookupHandler(kafka *client.KafkaConfig, partitioners map[string]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		topic := vars["topic"]
+		logger.Printf("Call for key %s of topic %s", vars["key"], topic)
+
+		query := r.URL.Query()
+		key, err := decodeKey(vars["key"], query.Get("encoding"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		options := client.DefaultKeyLookupOptions()
+		options.MaxVersions = keyLookupMaxVersions
+		options.Timeout = keyLookupTimeout
+		if partitioner, ok := partitioners[topic]; ok {
+			options.Partitioner = partitioner
+		}
+		if partitioner := query.Get("partitioner"); partitioner != "" {
+			err := client.CheckKeyPartitioner(partitioner)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			options.Partitioner = partitioner
+		}
+		if partition := query.Get("partition"); partition != "" {
+			p, err := strconv.ParseInt(partition, 10, 32)
+			if err != nil || p < 0 {
+				http.Error(w, fmt.Sprintf("invalid partition %q", partition), http.StatusBadRequest)
+				return
+			}
+			options.Partition = int32(p)
+		}
+		err = searchBounds(query, &options.Newest, &options.MaxVersions, &options.Timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		lookup, err := kafka.LookupKey(topic, key, options)
+		if err != nil {
+			logger.Printf("Error looking up key %s of topic %s: %s", vars["key"], topic, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(lookup)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// decodeKey reads a key written as text, hex or base64
+func decodeKey(key string, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "text":
+		return []byte(key), nil
+	case "hex":
+		return hex.DecodeString(key)
+	case "base64":
+		return base64.StdEncoding.DecodeString(key)
+	}
+	return nil, fmt.Errorf("unknown key encoding %q, expected text, hex or base64", encoding)
+}
+
+// parseBrokers reads the comma separated host:port list of KAFKA_BROKERS,
+// skipping blank entries
+func parseBrokers(list string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(list, ",") {
+		broker = strings.TrimSpace(broker)
+		if broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+// parseKeyPartitioners reads the topic=partitioner list of TOPIC_PARTITIONERS
+func parseKeyPartitioners(settings string) (map[string]string, error) {
+	parsed, err := parseTopicSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	partitioners := make(map[string]string)
+	for _, setting := range parsed {
+		if setting.key {
+			return nil, fmt.Errorf("write partitioners as topic=partitioner, not %s:key", setting.topic)
+		}
+		err = client.CheckKeyPartitioner(setting.value)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %s", setting.topic, err.Error())
+		}
+		partitioners[setting.topic] = setting.value
+	}
+	return partitioners, nil
+}
+
+// Defaults for refining offsets by time, which the query can change
+const (
+	timeOffsetMaxScan = 100000
+	timeOffsetTimeout = 30 * time.Second
+)
+
+// timeOffsetsHandler returns each partition's offset at the query's time. The
+// brokers' answers are refined by reading message times from the topic's
+// TOPIC_TIMESTAMPS field, or the query's field. The query may set scan (most
+// messages read per partition) and timeout for the refining.
+func timeOffsetsHandler(kafka *client.KafkaConfig, timeFields map[string]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := mux.Vars(r)["topic"]
+		query := r.URL.Query()
+		logger.Printf("Call for offsets of topic %s at %s", topic, query.Get("time"))
+
+		at, err := client.ParseTime(query.Get("time"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		options := client.TimeOffsetOptions{
+			TimeField: timeFields[topic],
+			MaxScan:   timeOffsetMaxScan,
+			Timeout:   timeOffsetTimeout,
+		}
+		if field, ok := query["field"]; ok {
+			options.TimeField = field[0]
+			if options.TimeField != "" {
+				err = client.CheckTimeField(options.TimeField)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid field %q: %s", options.TimeField, err.Error()), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if scan := query.Get("scan"); scan != "" {
+			options.MaxScan, err = strconv.ParseInt(scan, 10, 64)
+			if err != nil || options.MaxScan < 0 {
+				http.Error(w, fmt.Sprintf("invalid scan %q", scan), http.StatusBadRequest)
+				return
+			}
+		}
+		if timeout := query.Get("timeout"); timeout != "" {
+			options.Timeout, err = time.ParseDuration(timeout)
+			if err != nil || options.Timeout < 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", timeout), http.StatusBadRequest)
+				return
+			}
+		}
+
+		offsets, err := kafka.OffsetsForTime(topic, at, options)
+		if err != nil {
+			logger.Printf("Error finding offsets of topic %s at %s: %s", topic, at, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(offsets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// parseTimeFields reads the topic=field list of TOPIC_TIMESTAMPS
+func parseTimeFields(settings string) (map[string]string, error) {
+	parsed, err := parseTopicSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	for _, setting := range parsed {
+		if setting.key {
+			return nil, fmt.Errorf("write key fields as topic=key, not %s:key", setting.topic)
+		}
+		err = client.CheckTimeField(setting.value)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %s", setting.topic, err.Error())
+		}
+		fields[setting.topic] = setting.value
+	}
+	return fields, nil
+}
+
+// parseTraceTopics reads the topic=ID field list and the topic=timestamp field
+// list of the trace settings. Topics are traced in the order they are listed.
+func parseTraceTopics(idFields string, timeFields string) ([]client.TraceTopic, error) {
+	ids, err := parseTopicSettings(idFields)
+	if err != nil {
+		return nil, fmt.Errorf("TRACE_TOPICS: %s", err.Error())
+	}
+	times, err := parseTopicSettings(timeFields)
+	if err != nil {
+		return nil, fmt.Errorf("TRACE_TIMESTAMPS: %s", err.Error())
+	}
+
+	var topics []client.TraceTopic
+	index := make(map[string]int)
+	for _, setting := range ids {
+		if setting.key {
+			return nil, fmt.Errorf("TRACE_TOPICS: write key fields as topic=key, not %s:key", setting.topic)
+		}
+		index[setting.topic] = len(topics)
+		topics = append(topics, client.TraceTopic{Topic: setting.topic, IDField: setting.value})
+	}
+	for _, setting := range times {
+		i, ok := index[setting.topic]
+		if !ok || setting.key {
+			return nil, fmt.Errorf("TRACE_TIMESTAMPS: topic %s is not in TRACE_TOPICS", setting.topic)
+		}
+		topics[i].TimeField = setting.value
+	}
+
+	return topics, client.CheckTraceTopics(topics)
+}
+
+func clusterHealthHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Printf("Call for cluster health")
+
+		health, err := kafka.ClusterHealth()
+		if err != nil {
+			logger.Printf("Error checking cluster health: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(health)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+func brokerStatusHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := json.Marshal(kafka.BrokerStatus())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+func cacheStatsHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := json.Marshal(kafka.CacheStats())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// topicSetting is one entry of a topic=value list. The topic may end in
+// :key for a setting that applies to the topic's message keys.
+type topicSetting struct {
+	topic string
+	key   bool
+	value string
+}
+
+func parseTopicSettings(settings string) ([]topicSetting, error) {
+	var parsed []topicSetting
+	for _, setting := range strings.Split(settings, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected topic=value or topic:key=value, got %q", setting)
+		}
+		topic := strings.TrimSpace(parts[0])
+		key := strings.HasSuffix(topic, ":key")
+		parsed = append(parsed, topicSetting{
+			topic: strings.TrimSuffix(topic, ":key"),
+			key:   key,
+			value: strings.TrimSpace(parts[1]),
+		})
+	}
+	return parsed, nil
+}
+
+// setTopicDecoders applies a comma separated list of topic=decoder settings
+func setTopicDecoders(decoders *client.DecoderRegistry, settings string) error {
+	parsed, err := parseTopicSettings(settings)
+	if err != nil {
+		return err
+	}
+	for _, setting := range parsed {
+		if setting.key {
+			err = decoders.SetTopicKeyDecoder(setting.topic, setting.value)
+		} else {
+			err = decoders.SetTopicDecoder(setting.topic, setting.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerProtobuf adds the protobuf decoder for the message types in a descriptor
+// set, and sets it as the decoder of each topic given a type in topicTypes
+func registerProtobuf(decoders *client.DecoderRegistry, descriptorSet string, topicTypes string) error {
+	parsed, err := parseTopicSettings(topicTypes)
+	if err != nil {
+		return err
+	}
+	valueTypes, keyTypes := make(map[string]string), make(map[string]string)
+	for _, setting := range parsed {
+		if setting.key {
+			keyTypes[setting.topic] = setting.value
+		} else {
+			valueTypes[setting.topic] = setting.value
+		}
+	}
+
+	decoder, err := client.NewProtobufDecoder(descriptorSet, valueTypes, keyTypes)
+	if err != nil {
+		return err
+	}
+	decoders.Register(decoder, false)
+
+	for topic := range valueTypes {
+		decoders.SetTopicDecoder(topic, decoder.Name())
+	}
+	for topic := range keyTypes {
+		decoders.SetTopicKeyDecoder(topic, decoder.Name())
+	}
+	return nil
+}
+
+func decodersHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := json.Marshal(map[string]interface{}{
+			"decoders": append([]string{client.AutoDecoder}, kafka.Decoders().Names()...),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+// topicDecoderHandler returns the topic's value and key decoders
+func topicDecoderHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeTopicDecoders(w, kafka.Decoders(), mux.Vars(r)["topic"])
+	}
+}
+
+// setTopicDecoderHandler sets the topic's value and key decoders from the
+// decoder and key_decoder fields, then returns them
+func setTopicDecoderHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := mux.Vars(r)["topic"]
+		decoders := kafka.Decoders()
+
+		r.ParseForm()
+		_, hasKeyDecoder := r.Form["key_decoder"]
+		if _, ok := r.Form["decoder"]; ok || !hasKeyDecoder {
+			decoder := r.FormValue("decoder")
+			logger.Printf("Set decoder for topic %s to %s", topic, decoder)
+
+			err := decoders.SetTopicDecoder(topic, decoder)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if hasKeyDecoder {
+			decoder := r.FormValue("key_decoder")
+			logger.Printf("Set key decoder for topic %s to %s", topic, decoder)
+
+			err := decoders.SetTopicKeyDecoder(topic, decoder)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		writeTopicDecoders(w, decoders, topic)
+	}
+}
+
+// writeForbiddenHandler rejects writes to routes that are also readable,
+// when the server doesn't have W permission
+func writeForbiddenHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "writes are not permitted, PERMISSIONS does not include W", http.StatusForbidden)
+}
+
+func writeTopicDecoders(w http.ResponseWriter, decoders *client.DecoderRegistry, topic string) {
+	response, err := json.Marshal(map[string]string{
+		"topic":       topic,
+		"decoder":     decoders.TopicDecoder(topic),
+		"key_decoder": decoders.TopicKeyDecoder(topic),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func producerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			logger.Printf("Insert Data Request")
+			params := mux.Vars(r)
+			topic := params["topic"]
+			r.ParseForm()
+			data := r.FormValue("data")
+			logger.Printf("%+v", data)
+
+			options, err := produceOptions(r.Form)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			produced, err := kafka.Produce(data, topic, options)
+			if err != nil {
+				logger.Printf("Error producing to %s: %s", topic, err.Error())
+				produceError(w, err)
+				return
+			}
+
+			response, err := json.Marshal(produced)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(response)
+		}
+	}
+}
 
-	if strings.Contains(conf.permissions, "R") {
-		rtc.HandleFunc("/topics", topicDataHandler(kafka))                                            // get metadata
-		rtc.Handle("/topics/{topic}/poll", websocket.Handler(pollTopic(kafka)))                       // poll for topic metadata
-		rtc.Handle("/topics/socket/{topic}/{keyword}", websocket.Handler(socketSearchHandler(kafka))) // search data
-		rtc.HandleFunc("/topics/{topic}/{partition}/{offsetRange}", consumerHandler(kafka))           // get specific data
+// bulkProducerHandler produces every message in an uploaded file, sent either as the
+// "file" field of a multipart form or as the request body. Options are read from the query string.
+func bulkProducerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "bulk data can only be inserted with POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topic := mux.Vars(r)["topic"]
+		query := r.URL.Query()
+		format := client.BulkFormat{
+			Type:        query.Get("format"),
+			KeyColumn:   query.Get("key_column"),
+			ValueColumn: query.Get("value_column"),
+		}
+		logger.Printf("Bulk Insert Data Request. Topic: %s Format: %+v", topic, format)
+
+		options, err := produceOptions(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var upload io.Reader = r.Body
+		if reader, err := r.MultipartReader(); err == nil {
+			upload, err = multipartFile(reader, "file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		summary, err := kafka.ProduceBulk(topic, upload, format, options)
+		if err != nil && summary == nil {
+			logger.Printf("Error bulk producing to %s: %s", topic, err.Error())
+			produceError(w, err)
+			return
+		}
+
+		body := map[string]interface{}{"summary": summary}
+		status := http.StatusOK
+		if err != nil {
+			// The upload could not be read to the end, so only part of it was produced
+			logger.Printf("Error reading bulk upload for %s: %s", topic, err.Error())
+			body["error"] = err.Error()
+			status = http.StatusBadRequest
+		}
+
+		response, err := json.Marshal(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(response)
 	}
+}
 
-	if strings.Contains(conf.permissions, "W") {
-		rtc.HandleFunc("/topics/{topic}", producerHandler(kafka)) // insert data
+// multipartFile returns the contents of the named form field
+func multipartFile(reader *multipart.Reader, name string) (io.Reader, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %q field in upload", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
 	}
+}
 
-	rtc.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/kafka_viz")))
+// produceError responds with the status matching a failed produce,
+// including the Kafka error code when the broker gave one
+func produceError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	body := map[string]interface{}{"error": err.Error()}
 
-	bind := fmt.Sprintf("%s:%s", conf.host, conf.port)
-	logger.Printf("Listening on %s...", bind)
+	if code, ok := client.KafkaErrorCode(err); ok {
+		body["kafka_error_code"] = code
+		switch sarama.KError(code) {
+		case sarama.ErrUnknownTopicOrPartition:
+			status = http.StatusNotFound
+		case sarama.ErrInvalidMessageSize, sarama.ErrMessageSizeTooLarge:
+			status = http.StatusRequestEntityTooLarge
+		case sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut,
+			sarama.ErrNotEnoughReplicas, sarama.ErrNotEnoughReplicasAfterAppend:
+			status = http.StatusServiceUnavailable
+		}
+	}
 
-	err = http.ListenAndServe(bind, rtc)
+	response, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// produceOptions reads the optional key, partition, acks and compression fields
+func produceOptions(form url.Values) (client.ProduceOptions, error) {
+	options := client.DefaultProduceOptions()
+
+	if _, ok := form["key"]; ok {
+		options.Key = []byte(form.Get("key"))
+	}
+
+	if partitionStr := form.Get("partition"); partitionStr != "" {
+		partition, err := strconv.Atoi(partitionStr)
+		if err != nil || partition < 0 {
+			return options, fmt.Errorf("invalid partition %q", partitionStr)
+		}
+		options.Partition = int32(partition)
+	}
+
+	var err error
+	options.RequiredAcks, err = client.ParseRequiredAcks(form.Get("acks"))
 	if err != nil {
-		logger.Printf("Error serving: %s", err.Error())
-		cleanup()
-		os.Exit(1)
+		return options, err
+	}
+
+	options.Compression, err = client.ParseCompression(form.Get("compression"))
+	if err != nil {
+		return options, err
 	}
+
+	return options, nil
 }
 
-func topicDataHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+func groupLagHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		group := mux.Vars(r)["group"]
 		r.ParseForm()
 		topics := r.Form["topic"]
-		logger.Printf("Call for topic metadata. Topics: %s", topics)
+		logger.Printf("Call for consumer group lag. Group: %s Topics: %s", group, topics)
 
-		metadataResponse, err := kafka.TopicDataResponse(topics)
+		lag, err := kafka.GroupLag(group, topics)
+		if err != nil {
+			logger.Printf("Error getting lag for group %s: %s", group, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.Marshal(lag)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, string(metadataResponse[:]))
+		w.Write(response)
 	}
 }
 
-func producerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
+type offsetResetRequest struct {
+	Topic      string            `json:"topic"`
+	To         string            `json:"to"`         // target for every partition of the topic
+	Partitions map[string]string `json:"partitions"` // per partition targets, overriding To
+	DryRun     bool              `json:"dry_run"`
+}
+
+func offsetResetHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			logger.Printf("Insert Data Request")
-			params := mux.Vars(r)
-			topic := params["topic"]
-			r.ParseForm()
-			data := r.FormValue("data")
-			logger.Printf("%+v", data)
-			kafka.Produce(data, topic)
-			w.WriteHeader(204)
+		if r.Method != "POST" {
+			http.Error(w, "offsets can only be reset with POST", http.StatusMethodNotAllowed)
+			return
 		}
-	}
-}
 
-func offsetRangeFromString(offsetRange string) (int, int, error) {
-	if strings.Contains(offsetRange, "-") {
-		parsedRange := strings.Split(offsetRange, "-")
-		offsetStart, err := strconv.Atoi(parsedRange[0])
+		group := mux.Vars(r)["group"]
+		var request offsetResetRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
-			return -1, -1, err
+			http.Error(w, "Invalid offset reset request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Topic == "" {
+			http.Error(w, "A topic is required", http.StatusBadRequest)
+			return
+		}
+		logger.Printf("Offset reset request. Group: %s Request: %+v", group, request)
+
+		partitions, err := kafka.Partitions(request.Topic)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := make(map[int32]string)
+		if request.To != "" {
+			for _, partition := range partitions {
+				targets[partition] = request.To
+			}
+		}
+		for partitionStr, target := range request.Partitions {
+			partition, err := strconv.ParseInt(partitionStr, 10, 32)
+			if err != nil || partition < 0 {
+				http.Error(w, "Invalid partition: "+partitionStr, http.StatusBadRequest)
+				return
+			}
+			if partition >= int64(len(partitions)) {
+				http.Error(w, fmt.Sprintf("Topic %s has no partition %d", request.Topic, partition), http.StatusBadRequest)
+				return
+			}
+			targets[int32(partition)] = target
+		}
+		if len(targets) == 0 {
+			http.Error(w, "No offset targets given", http.StatusBadRequest)
+			return
 		}
 
-		offsetEnd, err := strconv.Atoi(parsedRange[1])
+		changes, err := kafka.ResetGroupOffsets(group, request.Topic, targets, request.DryRun)
 		if err != nil {
-			return -1, -1, err
+			logger.Printf("Error resetting offsets for group %s: %s", group, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		offsetLength := offsetEnd - offsetStart + 1
-		if offsetLength < 0 {
-			offsetLength = -offsetLength
+		response, err := json.Marshal(map[string]interface{}{
+			"group":   group,
+			"dry_run": request.DryRun,
+			"changes": changes,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		return offsetStart, offsetLength, nil
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
 	}
+}
 
-	offsetLength := 1
-	offsetStart, err := strconv.Atoi(offsetRange)
-	if err != nil {
-		return -1, -1, err
+// Most messages an offset range may return, unless the query sets limit.
+// Ranges without an end are cut to it, and others may not cover more.
+const rangeLimit = 1000
+
+// offsetRangeError answers with an offset range error as JSON, so clients can
+// tell what was wrong with the range
+func offsetRangeError(w http.ResponseWriter, err *client.OffsetRangeError) {
+	status := http.StatusBadRequest
+	if err.Code == "empty" || err.Code == "out_of_range" {
+		status = http.StatusRequestedRangeNotSatisfiable
 	}
-	return offsetStart, offsetLength, nil
 
+	response, jsonErr := json.Marshal(err)
+	if jsonErr != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
 }
 
+// How long reading an offset range may take, unless the query sets timeout
+const consumeTimeout = 10 * time.Second
+
+// consumerHandler returns the messages in an offset range of a partition, or as
+// many of them as were read before the log ended or the timeout passed.
 func consumerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("Consume Data Request")
@@ -150,20 +1009,58 @@ func consumerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *h
 			return
 		}
 
-		offsetStart, offsetLength, err := offsetRangeFromString(offsetRange)
+		parsedRange, err := client.ParseOffsetRange(offsetRange)
 		if err != nil {
-			logger.Printf("Invalid partition range: %s", offsetRange)
-			logger.Printf("Invalid partition error: %s", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Printf("Invalid offset range %s: %s", offsetRange, err.Error())
+			offsetRangeError(w, err.(*client.OffsetRangeError))
 			return
 		}
 
-		data, err := kafka.ConsumeOffsets(offsetStart, offsetLength, topic, partition)
+		limit := int64(rangeLimit)
+		if text := r.URL.Query().Get("limit"); text != "" {
+			limit, err = strconv.ParseInt(text, 10, 64)
+			if err != nil || limit <= 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", text), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Only ask for offsets the partition still holds
+		start, end, err := kafka.ResolveOffsetRange(topic, int32(partition), parsedRange, limit)
+		if rangeErr, ok := err.(*client.OffsetRangeError); ok {
+			logger.Printf("Offset range %s not available in %s/%d: %s", offsetRange, topic, partition, err.Error())
+			offsetRangeError(w, rangeErr)
+			return
+		}
 		if err != nil {
+			logger.Printf("Error getting offsets for %s/%d: %s", topic, partition, err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		timeout := consumeTimeout
+		if text := r.URL.Query().Get("timeout"); text != "" {
+			timeout, err = time.ParseDuration(text)
+			if err != nil || timeout <= 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", text), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Whatever was read before an error or the timeout is still worth showing
+		data, err := kafka.ConsumeOffsets(int(start), int(end-start), topic, partition, timeout)
+		if err != nil {
+			logger.Printf("Error consuming %s/%d offsets %s after %d messages: %s", topic, partition, offsetRange, len(data), err.Error())
+			if len(data) == 0 {
+				status := http.StatusInternalServerError
+				if err == client.ErrFetchTimeout {
+					status = http.StatusGatewayTimeout
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
 		response, err := json.Marshal(data)
 		if err != nil {
 			logger.Printf("Error consuming from kafka. Err: %s", err.Error())
@@ -172,93 +1069,333 @@ func consumerHandler(kafka *client.KafkaConfig) func(w http.ResponseWriter, r *h
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, string(response))
+		w.Write(response)
 	}
 }
 
+// How often a running search reports its progress
+const searchProgressInterval = 500 * time.Millisecond
+
+// searchRequest is the first frame a search client sends. It searches Topic,
+// Topics and every topic whose name matches TopicPattern. The bounds are those
+// of client.SearchOptions; Cursor continues a search that stopped early, on the
+// topics it stopped in. While the search runs the client may send
+// {"type": "cancel"} to stop it.
+type searchRequest struct {
+	Type         string              `json:"type"` // search
+	Topic        string              `json:"topic"`
+	Topics       []string            `json:"topics"`
+	TopicPattern string              `json:"topic_pattern"`
+	Filter       string              `json:"filter"`
+	From         int64               `json:"from"`
+	To           int64               `json:"to"`
+	Newest       int64               `json:"newest"`
+	Limit        int                 `json:"limit"`
+	Cursor       client.SearchCursor `json:"cursor"`
+}
+
+// Frames a search sends back: a match per message found, progress every
+// searchProgressInterval, error if the search or a partition fails, and done last.
+type searchMatchFrame struct {
+	Type string `json:"type"` // match
+	*client.MessageMatch
+}
+
+type searchProgressFrame struct {
+	Type       string                     `json:"type"` // progress
+	Matches    int                        `json:"matches"`
+	Partitions []client.PartitionProgress `json:"partitions"`
+}
+
+type searchErrorFrame struct {
+	Type      string `json:"type"` // error
+	Error     string `json:"error"`
+	Position  *int   `json:"position,omitempty"` // where in the filter the error is
+	Topic     string `json:"topic,omitempty"`
+	Partition *int32 `json:"partition,omitempty"`
+}
+
+type searchDoneFrame struct {
+	Type      string                `json:"type"` // done
+	Matches   int                   `json:"matches"`
+	Scanned   int64                 `json:"scanned"`
+	Total     int64                 `json:"total"`
+	ElapsedMs int64                 `json:"elapsed_ms"`
+	Cancelled bool                  `json:"cancelled"`
+	Cursor    client.SearchCursor   `json:"cursor,omitempty"` // set if the search stopped before the end of its window
+	Topics    []client.TopicSummary `json:"topics"`
+}
+
 func socketSearchHandler(kafka *client.KafkaConfig) func(*websocket.Conn) {
 	return func(ws *websocket.Conn) {
+		defer ws.Close()
 
-		// Get topic and search string from websocket
-		var topic string
-		var keyword string
-		err := websocket.Message.Receive(ws, &topic)
+		var request searchRequest
+		err := websocket.JSON.Receive(ws, &request)
 		if err == io.EOF {
 			logger.Println("kafka search websocket EOF")
 			return
 		}
 		if err != nil {
 			logger.Printf("Error reading from websocket: %s", err.Error())
+			websocket.JSON.Send(ws, searchErrorFrame{Type: "error", Error: "invalid search request: " + err.Error()})
 			return
 		}
 
-		err = websocket.Message.Receive(ws, &keyword)
-		if err == io.EOF {
-			logger.Println("kafka search websocket EOF")
-			return
-		}
+		// Report a bad request before any partition is read
+		topics, options, err := request.options(kafka)
 		if err != nil {
-			logger.Printf("Error reading from websocket: %s", err.Error())
+			logger.Printf("Invalid search %q: %s", request.Filter, err.Error())
+			frame := searchErrorFrame{Type: "error", Error: err.Error()}
+			if filterErr, ok := err.(*client.FilterError); ok {
+				frame.Error, frame.Position = filterErr.Message, &filterErr.Position
+			}
+			websocket.JSON.Send(ws, frame)
 			return
 		}
 
-		logger.Printf("Searching topic %s for %q", topic, keyword)
-		defer logger.Printf("Done searching topic %s for %q", topic, keyword)
-		found := make(chan client.MessageMatch)
-		stopSearch := make(chan struct{})
-		isFound := false
-
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			kafka.SearchTopic(found, stopSearch, topic, keyword)
-		}()
+		logger.Printf("Searching topics %v for %q", topics, request.Filter)
+		defer logger.Printf("Done searching topics %v for %q", topics, request.Filter)
 
+		// A cancel frame, or the client going away, stops the search
+		stopSearch := make(chan struct{})
 		go func() {
+			defer close(stopSearch)
 			for {
-				select {
-				case match := <-found:
-					matchBytes, err := json.Marshal(match)
-					if err != nil {
-						logger.Printf("Error marshalling match: %s", err.Error())
-					}
-					io.Copy(ws, bytes.NewReader(matchBytes))
-					isFound = true
-				case <-stopSearch:
+				var frame struct {
+					Type string `json:"type"`
+				}
+				err := websocket.JSON.Receive(ws, &frame)
+				if err != nil || frame.Type == "cancel" {
 					return
-				default:
 				}
 			}
 		}()
 
-		wg.Wait()
-		close(stopSearch)
-		close(found)
-		if !isFound {
-			io.Copy(ws, strings.NewReader("Not Found"))
+		started := time.Now()
+		found := make(chan client.MessageMatch)
+		finished := make(chan struct{})
+		var cursor client.SearchCursor
+		go func() {
+			defer close(finished)
+			cursor = kafka.SearchTopics(found, stopSearch, topics, options)
+		}()
+
+		progress := time.NewTicker(searchProgressInterval)
+		defer progress.Stop()
+
+		matches := 0
+	search:
+		for {
+			select {
+			case match := <-found:
+				matches++
+				websocket.JSON.Send(ws, searchMatchFrame{Type: "match", MessageMatch: &match})
+			case <-progress.C:
+				websocket.JSON.Send(ws, searchProgressFrame{Type: "progress", Matches: matches, Partitions: options.Progress.Snapshot()})
+			case <-finished:
+				break search
+			}
 		}
-		ws.Close()
-		return
-	}
 
+		done := searchDoneFrame{
+			Type:      "done",
+			Matches:   matches,
+			ElapsedMs: int64(time.Since(started) / time.Millisecond),
+			Cursor:    cursor,
+			Topics:    options.Progress.Topics(),
+		}
+		for _, topic := range done.Topics {
+			if topic.Error != "" {
+				logger.Printf("Error searching topic %s: %s", topic.Topic, topic.Error)
+				websocket.JSON.Send(ws, searchErrorFrame{Type: "error", Error: topic.Error, Topic: topic.Topic})
+			}
+		}
+		partitions := options.Progress.Snapshot()
+		for i, partition := range partitions {
+			if partition.Error != "" {
+				websocket.JSON.Send(ws, searchErrorFrame{Type: "error", Error: partition.Error, Topic: partition.Topic, Partition: &partitions[i].Partition})
+			}
+			done.Scanned += partition.Scanned
+			done.Total += partition.Total
+		}
+		select {
+		case <-stopSearch:
+			done.Cancelled = true
+		default:
+		}
+		websocket.JSON.Send(ws, searchProgressFrame{Type: "progress", Matches: matches, Partitions: partitions})
+		websocket.JSON.Send(ws, done)
+	}
 }
 
-// Echo the data received on the WebSocket.
-func pollTopic(kafka *client.KafkaConfig) func(*websocket.Conn) {
-	closeChan := make(chan struct{})
-	openChan := make(chan struct{}, 1)
+// options checks a search request and turns it into the topics and options for SearchTopics
+func (request searchRequest) options(kafka *client.KafkaConfig) ([]string, client.SearchOptions, error) {
+	options := client.SearchOptions{
+		FromOffset: request.From,
+		ToOffset:   request.To,
+		Newest:     request.Newest,
+		MaxMatches: request.Limit,
+		Cursor:     request.Cursor,
+		Progress:   client.NewSearchProgress(),
+	}
+	if request.Type != "search" {
+		return nil, options, fmt.Errorf("expected a search frame, got %q", request.Type)
+	}
+	if request.From < 0 || request.To < 0 || request.Newest < 0 || request.Limit < 0 {
+		return nil, options, fmt.Errorf("from, to, newest and limit can't be negative")
+	}
+
+	filter, err := client.ParseFilter(request.Filter)
+	if err != nil {
+		return nil, options, err
+	}
+	options.Filter = filter
+
+	if request.Cursor != nil {
+		err := client.CheckSearchCursor(request.Cursor)
+		if err != nil {
+			return nil, options, err
+		}
+		var topics []string
+		for topic := range request.Cursor {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			partitions, err := kafka.Partitions(topic)
+			if err != nil {
+				return nil, options, err
+			}
+			for partition := range request.Cursor[topic] {
+				if partition >= int32(len(partitions)) {
+					return nil, options, fmt.Errorf("cursor: topic %s has no partition %d", topic, partition)
+				}
+			}
+		}
+		return topics, options, nil
+	}
+
+	topics := request.Topics
+	if request.Topic != "" {
+		topics = append([]string{request.Topic}, topics...)
+	}
+	if request.TopicPattern != "" {
+		pattern, err := regexp.Compile(request.TopicPattern)
+		if err != nil {
+			return nil, options, fmt.Errorf("invalid topic pattern: %s", err.Error())
+		}
+		matching, err := kafka.MatchingTopics(pattern)
+		if err != nil {
+			return nil, options, err
+		}
+		if len(matching) == 0 {
+			return nil, options, fmt.Errorf("no topics match %q", request.TopicPattern)
+		}
+		topics = append(topics, matching...)
+	}
+	if len(topics) == 0 {
+		return nil, options, fmt.Errorf("no topic to search")
+	}
+
+	// Search each topic once, however many ways it was named
+	seen := make(map[string]bool)
+	var unique []string
+	for _, topic := range topics {
+		if !seen[topic] {
+			seen[topic] = true
+			unique = append(unique, topic)
+		}
+	}
+	return unique, options, nil
+}
 
+// tailHandler streams messages as they arrive on a topic. The query may set
+// partition (default all), offset (newest, oldest or an offset; default newest),
+// filter (a regexp matched against each decoded value and key) and rate (most
+// messages per second). Each frame is a JSON message, dropped or error event.
+func tailHandler(kafka *client.KafkaConfig) func(*websocket.Conn) {
 	return func(ws *websocket.Conn) {
-		// close previous polling
-		// ignore if there wasn't a previous polling
-		select {
-		case <-openChan:
-			logger.Printf("New polling request. Close previous polling")
-			closeChan <- struct{}{}
-		default:
+		defer ws.Close()
+
+		topic := mux.Vars(ws.Request())["topic"]
+		options, err := tailOptions(ws.Request().URL.Query())
+		if err != nil {
+			websocket.JSON.Send(ws, client.TailNotice{Type: "error", Partition: -1, Error: err.Error()})
+			return
+		}
+
+		// The client sends nothing, so a failed read means it has gone
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var msg string
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+		}()
+
+		events, err := kafka.Tail(topic, options, closed)
+		if err != nil {
+			logger.Printf("Error tailing topic %s: %s", topic, err.Error())
+			websocket.JSON.Send(ws, client.TailNotice{Type: "error", Partition: options.Partition, Error: err.Error()})
+			return
+		}
+		logger.Printf("Tailing topic %s", topic)
+		defer logger.Printf("Stopped tailing topic %s", topic)
+
+		for event := range events {
+			err := websocket.JSON.Send(ws, event)
+			if err != nil {
+				logger.Printf("Error writing to tail websocket: %s", err.Error())
+				ws.Close()
+				// Wait for Tail to see the closed connection and stop its consumers
+				for range events {
+				}
+				return
+			}
+		}
+	}
+}
+
+func tailOptions(query url.Values) (client.TailOptions, error) {
+	options := client.TailOptions{Partition: -1}
+
+	if partition := query.Get("partition"); partition != "" {
+		p, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil || p < 0 {
+			return options, fmt.Errorf("invalid partition %q", partition)
+		}
+		options.Partition = int32(p)
+	}
+
+	offset, err := client.ParseTailOffset(query.Get("offset"))
+	if err != nil {
+		return options, err
+	}
+	options.Offset = offset
+
+	if filter := query.Get("filter"); filter != "" {
+		re, err := regexp.Compile(filter)
+		if err != nil {
+			return options, fmt.Errorf("invalid filter: %s", err.Error())
+		}
+		options.Filter = re
+	}
+
+	if rate := query.Get("rate"); rate != "" {
+		r, err := strconv.Atoi(rate)
+		if err != nil || r < 0 {
+			return options, fmt.Errorf("invalid rate %q", rate)
 		}
-		openChan <- struct{}{}
+		options.MaxRate = r
+	}
+	return options, nil
+}
+
+// Stream a topic's metadata through the websocket until the client goes away.
+func pollTopic(hub *client.PollHub) func(*websocket.Conn) {
+	return func(ws *websocket.Conn) {
+		defer ws.Close()
 
 		// Get topic from websocket
 		var topic string
@@ -273,19 +1410,30 @@ func pollTopic(kafka *client.KafkaConfig) func(*websocket.Conn) {
 		}
 		logger.Printf("Poll Topic %s", topic)
 
-		// Poll that topic
-		topicDataChan := make(chan string)
-		go kafka.Poll(topic, topicDataChan, closeChan) // poll for current topic metadata
+		updates := hub.Subscribe(topic)
+		defer hub.Unsubscribe(topic, updates)
+
+		// The client sends nothing more, so a failed read means it has gone
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var msg string
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+		}()
 
 		// Send polling results back through websocket
 		for {
 			select {
-			case topicData := <-topicDataChan:
-				io.Copy(ws, strings.NewReader(topicData))
-			case <-closeChan:
+			case topicData := <-updates:
+				_, err := io.Copy(ws, strings.NewReader(topicData))
+				if err != nil {
+					logger.Printf("Error writing to polling websocket: %s", err.Error())
+					return
+				}
+			case <-closed:
 				logger.Printf("polling stopped for topic %s", topic)
 				return
-
 			}
 		}
 	}
@@ -299,9 +1447,21 @@ func configFromEnv() {
 	conf.logFile = os.Getenv("LOG_FILE")
 	conf.kafkaHost = os.Getenv("KAFKA_HOST")
 	conf.kafkaPort = os.Getenv("KAFKA_PORT")
+	conf.kafkaBrokers = os.Getenv("KAFKA_BROKERS")
 	conf.kafkaBinDir = os.Getenv("KAFKA_BIN_DIR")
 	conf.kafkaConfigDir = os.Getenv("KAFKA_CONFIG_DIR")
 	conf.permissions = os.Getenv("PERMISSIONS")
+	conf.pollInterval = os.Getenv("POLL_INTERVAL")
+	conf.topicDecoders = os.Getenv("TOPIC_DECODERS")
+	conf.avroSchemaDir = os.Getenv("AVRO_SCHEMA_DIR")
+	conf.schemaRegistry = os.Getenv("SCHEMA_REGISTRY_URL")
+	conf.protoDescriptor = os.Getenv("PROTO_DESCRIPTOR_SET")
+	conf.protoTopics = os.Getenv("PROTO_TOPICS")
+	conf.traceTopics = os.Getenv("TRACE_TOPICS")
+	conf.traceTimestamps = os.Getenv("TRACE_TIMESTAMPS")
+	conf.partitioners = os.Getenv("TOPIC_PARTITIONERS")
+	conf.messageCacheMB = os.Getenv("MESSAGE_CACHE_MB")
+	conf.timeFields = os.Getenv("TOPIC_TIMESTAMPS")
 
 	// defaults
 	if conf.host == "" {
@@ -322,9 +1482,18 @@ func configFromEnv() {
 	if conf.kafkaPort == "" {
 		conf.kafkaPort = "9092"
 	}
+	if conf.kafkaBrokers == "" {
+		conf.kafkaBrokers = conf.kafkaHost + ":" + conf.kafkaPort
+	}
 	if conf.permissions == "" {
 		conf.permissions = "R" // Read only, can't mutate kafka store
 	}
+	if conf.pollInterval == "" {
+		conf.pollInterval = "1s"
+	}
+	if conf.messageCacheMB == "" {
+		conf.messageCacheMB = "64"
+	}
 }
 
 func initializeLogger() {
@@ -1,39 +1,97 @@
 var selectedPartition = 0;
 var currentTopic = "";
+var topicSocket = null;
 
 $(document).ready(function(){
   loadTopics(pollTopic);
+  checkClusterHealth();
   $("#topicDropdownBtn").click(function(){
     showTopicDropdown();
   });
 })
 
-var searchTopic = function(currentTopic, keyword) {
-  var searchSocket = new WebSocket("ws://localhost:8090/topics/socket/"+currentTopic+"/"+encodeURIComponent(keyword));
+// Matches shown per page of search results
+var searchPageSize = 100;
+
+var searchTopic = function(currentTopic, keyword, cursor) {
+  var searchSocket = new WebSocket("ws://localhost:8090/search");
   var topicSearchResults = $("#"+currentTopic+"SearchResults");
-  topicSearchResults.html("");
+  if (!cursor) {
+    topicSearchResults.html("");
+  }
 
   searchSocket.onopen = function (event) {
     if (currentTopic !== "" && keyword !== "") {
-        searchSocket.send(currentTopic);
-        searchSocket.send(keyword);
+      searchSocket.send(JSON.stringify({
+        type: "search",
+        topic: currentTopic,
+        filter: keyword,
+        limit: searchPageSize,
+        cursor: cursor || null
+      }));
     }
   }
 
-
+  var status = $("<p class='searchStatus'>");
+  var cancel = $("<a class='btn'>Cancel</a>");
+  cancel.click(function() {
+    searchSocket.send(JSON.stringify({type: "cancel"}));
+  });
   var dataList = $("<ul class='collection'>");
-  topicSearchResults.append(dataList);
+  topicSearchResults.append(status, cancel, dataList);
+  topicSearchResults.show();
 
-  var datum;
   searchSocket.onmessage = function (event) {
-    data = JSON.parse(event.data);
-    topicSearchResults.show();
-    dataList.append( $( "<li class='collection-item'><span class='title'>Partition: "+data.partition+" Offset: "+data.offset+"</span><p>"+data.message+"</p></li>"));
+    var data = JSON.parse(event.data);
+    switch (data.type) {
+    case "match":
+      var match = $( "<li class='collection-item'><span class='title'></span><pre></pre></li>");
+      match.find(".title").text("Topic: "+data.topic+" Partition: "+data.partition+" Offset: "+data.offset);
+      match.find("pre").text(data.message);
+      dataList.append(match);
+      break;
+    case "progress":
+      var scanned = 0, total = 0;
+      for (i in data.partitions) {
+        scanned += data.partitions[i].scanned;
+        total += data.partitions[i].total;
+      }
+      status.text("Searched "+scanned+" of "+total+" messages, "+data.matches+" found");
+      break;
+    case "error":
+      var error = $("<p>");
+      if (data.position !== undefined) {
+        error.text("Invalid search at position "+data.position+": "+data.error);
+      } else if (data.partition !== undefined) {
+        error.text("Partition "+data.partition+": "+data.error);
+      } else {
+        error.text(data.error);
+      }
+      topicSearchResults.append(error);
+      break;
+    case "done":
+      cancel.remove();
+      status.text((data.cancelled ? "Cancelled after searching " : "Searched ")+data.scanned+" of "+data.total+" messages in "+data.elapsed_ms+"ms, "+data.matches+" found");
+      if (data.cursor) {
+        var nextCursor = data.cursor;
+        var more = $("<a class='btn'>More results</a>");
+        more.click(function() {
+          more.remove();
+          searchTopic(currentTopic, keyword, nextCursor);
+        });
+        topicSearchResults.append(more);
+      }
+      break;
+    }
   }
 }
 
 var pollTopic = function(currentTopic) {
-  var topicSocket = new WebSocket("ws://localhost:8090/topics/"+currentTopic+"/poll");
+  // Only poll the topic being shown
+  if (topicSocket !== null) {
+    topicSocket.close();
+  }
+  topicSocket = new WebSocket("ws://localhost:8090/topics/"+currentTopic+"/poll");
 
   topicSocket.onopen = function (event) {
     if (currentTopic !== "") {
@@ -49,6 +107,22 @@ var pollTopic = function(currentTopic) {
   }
 }
 
+// Warn in the nav bar when partitions are offline, under-replicated or led by the wrong broker
+var checkClusterHealth = function() {
+  $.get("/health/cluster", function(health) {
+    var warning = $("#clusterHealth");
+    if (health.healthy) {
+      warning.hide();
+      return;
+    }
+    warning.html(
+        "offline: "+health.offline.length+
+        ", under-replicated: "+health.under_replicated.length+
+        ", not preferred leader: "+health.not_preferred_leader.length);
+    warning.show();
+  });
+}
+
 var showTopicDropdown = function() {
   $("#topics").show();
 }
@@ -83,15 +157,15 @@ var publishMessage = function(topicName) {
 }
 
 // Returns partition range from topic input box
-// Returns default newest 5, if not specified
-var partitionRange = function(topicName, partitionLength) {
-  if (partitionLength === 0) {
-    $('#'+topicName+"PartitionRange").val("0");
-    return 0;
+// Returns default newest 5 retained offsets, if not specified
+var partitionRange = function(topicName, earliest, latest) {
+  if (latest <= earliest) {
+    $('#'+topicName+"PartitionRange").val("" + earliest);
+    return earliest;
   }
-  partitionLength -= 1;
-  var lenMinusFive = partitionLength < 5 ? 0 : partitionLength - 5;
-  range = "" + lenMinusFive + "-" + partitionLength;
+  latest -= 1;
+  var lenMinusFive = latest - earliest < 5 ? earliest : latest - 5;
+  range = "" + lenMinusFive + "-" + latest;
   $('#'+topicName+"PartitionRange").val(range);
   $('#'+topicName+"PartitionRange").focus();
   return range;
@@ -103,17 +177,29 @@ var showPartitionData = function(topicName, partition, range) {
     var dataDiv = $('#'+topicName+"Data"); //.html(result.join("<br>"));
     dataDiv.html("");
 
-    var url = "/topics/"+topicName+"/"+partition+"/"+range;
+    var url = "/topics/"+topicName+"/"+partition+"/"+encodeURIComponent(range);
     $.get(url, function(result) {
       for (i in result) {
         message = result[i].message;
+        if (result[i].key) {
+          message = "Key: "+result[i].key.message+"\n"+message;
+        }
         offset = result[i].offset;
-        var datum = $( "<li><span class='pull-left'>"+offset+"</span><span class='pull-right'>"+message+"<span></li>");
+        var datum = $( "<li><span class='pull-left'>"+offset+"</span><span class='pull-right'><pre></pre><span></li>");
+        datum.find("pre").text(message);
         datum.append("<hr/>");
         dataList.append(datum);
       }
       dataDiv.append(dataList);
       dataDiv.show();
+    }).fail(function(xhr) {
+      // Offset range errors are JSON that says what was wrong
+      if (xhr.responseJSON && xhr.responseJSON.error) {
+        dataDiv.text(xhr.responseJSON.error);
+      } else {
+        dataDiv.text(xhr.responseText);
+      }
+      dataDiv.show();
     });
 }
 
@@ -122,11 +208,11 @@ var activatePartitionButton = function(button, topicName, partition) {
     $(button).addClass('btn-active');
 }
 
-var partitionClick = function(topicName, partition, partitionLength) {
+var partitionClick = function(topicName, partition, earliest, latest) {
   return function() {
     selectedPartition = partition;
     activatePartitionButton(this, topicName, partition);
-    range = partitionRange(topicName, partitionLength);
+    range = partitionRange(topicName, earliest, latest);
     showPartitionData(topicName, partition, range);
   }
 }
@@ -230,7 +316,7 @@ var showTopicData = function(topic) {
   var newSearchBoxCol = $("<div class='col s12' />");
   var newSearchInputBox = $(
       "<div class='input-field'>"+
-        "<label for='"+topicName+"Search'>Search Topic</label>"+
+        "<label for='"+topicName+"Search'>Search Topic (e.g. order-7, or value.status = \"PAID\" AND offset >= 100)</label>"+
         "<input type=text id='"+topicName+"Search'>"+
       "</div>");
   newSearchInputBox.bind('keypress', topicSearchKeyPress(topic));
@@ -289,9 +375,18 @@ var showPartitions = function(topic, newLeft) {
     partitionLength = topic.partition_info[j].length;
     partitionId = topic.partition_info[j].id;
     var partitionHTML = $("<div class='btn partition z-depth-1'>"+partitionLength+"</div>");
+    partitionHTML.attr('title', "retained: "+topic.partition_info[j].retained+
+        " (offsets "+topic.partition_info[j].earliest+"-"+topic.partition_info[j].latest+")"+
+        ", leader: "+topic.partition_info[j].leader+
+        ", replicas: "+topic.partition_info[j].replicas+
+        ", isr: "+topic.partition_info[j].isr);
+    if (topic.partition_info[j].under_replicated) {
+      partitionHTML.addClass('underReplicated');
+    }
     newLeft.append(partitionHTML);
 
-    partitionHTML.click(partitionClick(topic.name, partitionId, partitionLength));
+    partitionHTML.click(partitionClick(topic.name, partitionId,
+          topic.partition_info[j].earliest, topic.partition_info[j].latest));
 
   }
 }